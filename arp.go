@@ -2,17 +2,42 @@ package netlibk
 
 import (
 	"encoding/binary"
-	"fmt"
+	"errors"
 	"io"
 	"net"
+	"net/netip"
 )
 
+// send an arp request for the ip, the sender ip is the client address on the same subnet as the target
 func (c *Client) ARPRequest(ip net.IP) error {
-	if c.SourceIp == nil {
+	target, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return ErrInvalidIP
+	}
+	return c.ARPRequestAddr(target.Unmap())
+}
+
+// send an arp request for the ip with the given sender ip
+func (c *Client) ARPRequestFrom(ip, sourceIp net.IP) error {
+	source, ok := netip.AddrFromSlice(sourceIp)
+	if !ok {
 		return ErrInvalidClient
 	}
+	target, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return ErrInvalidIP
+	}
+	return c.ARPRequestFromAddr(target.Unmap(), source.Unmap())
+}
+
+// same as ARPRequest but with netip addresses
+func (c *Client) ARPRequestAddr(ip netip.Addr) error {
+	return c.ARPRequestFromAddr(ip, c.sourceAddrFor(ip))
+}
 
-	arp, err := BuildARPPacket(OperationRequest, c.SourceIp, ip, c.SourceHardwareAddr, EthernetBroadcast)
+// same as ARPRequestFrom but with netip addresses
+func (c *Client) ARPRequestFromAddr(ip, sourceIp netip.Addr) error {
+	arp, err := c.arpRequest(ip, sourceIp)
 	if err != nil {
 		return err
 	}
@@ -22,16 +47,50 @@ func (c *Client) ARPRequest(ip net.IP) error {
 	// 	return fmt.Errorf("Error building ethernet header: %v\n", err)
 	// }
 
+	c.logger().Debug("sending arp request", "sender_ip", sourceIp, "target_ip", ip)
 	return c.Write(arp, EthernetBroadcast)
 }
 
+// the broadcast arp request for the ip from the client
+func (c *Client) arpRequest(ip, sourceIp netip.Addr) (*ARPPacket, error) {
+	if !sourceIp.Is4() {
+		return nil, ErrInvalidClient
+	}
+	if !ip.Is4() {
+		return nil, ErrInvalidIP
+	}
+
+	return BuildARPPacketAddr(OperationRequest, sourceIp, ip, c.SourceHardwareAddr, EthernetBroadcast)
+}
+
+// the arp request for the ip as a message of a batch write, the whole frame
+// or on a cooked socket only the arp packet with the broadcast address for the kernel
+func (c *Client) arpRequestMessage(ip netip.Addr) (Message, error) {
+	arp, err := c.arpRequest(ip, c.sourceAddrFor(ip))
+	if err != nil {
+		return Message{}, err
+	}
+	payload, err := arp.Marshal()
+	if err != nil {
+		return Message{}, err
+	}
+	if c.cooked() {
+		return Message{Buffer: payload, Addr: &Address{HardwareAddr: EthernetBroadcast, Protocol: ARP_PROTOCOL}}, nil
+	}
+	b, err := c.buildFrame(EthernetBroadcast, ARP_PROTOCOL, payload)
+	return Message{Buffer: b}, err
+}
+
 func BuildARPPacket(op Operation, sourceIp, targetIp net.IP, sourceMac, destMac net.HardwareAddr) (*ARPPacket, error) {
+	hlen := len(sourceMac)
+	if hlen == 0 {
+		hlen = 6
+	}
 
 	return &ARPPacket{
-		HardwareType: 1,                     // default to 1 -> ethernet
-		ProtocolType: uint16(IPv4_PROTOCOL), // default to 0x800 ethernet type -> IPv4
-		// HardwareAddrLength: uint8(len(sourceMac)),
-		HardwareAddrLength: uint8(4),
+		HardwareType:       1,                     // default to 1 -> ethernet
+		ProtocolType:       uint16(IPv4_PROTOCOL), // default to 0x800 ethernet type -> IPv4
+		HardwareAddrLength: uint8(hlen),
 		ProtocolLength:     uint8(4),
 		Operation:          op,
 		SenderHardwareAddr: sourceMac,
@@ -41,6 +100,33 @@ func BuildARPPacket(op Operation, sourceIp, targetIp net.IP, sourceMac, destMac
 	}, nil
 }
 
+// same as BuildARPPacket but with netip addresses
+func BuildARPPacketAddr(op Operation, sourceIp, targetIp netip.Addr, sourceMac, destMac net.HardwareAddr) (*ARPPacket, error) {
+	if !sourceIp.Is4() || !targetIp.Is4() {
+		return nil, ErrInvalidIP
+	}
+
+	// one allocation for both of the addresses
+	b := make([]byte, 8)
+	s, t := sourceIp.As4(), targetIp.As4()
+	copy(b[0:4], s[:])
+	copy(b[4:8], t[:])
+
+	return BuildARPPacket(op, net.IP(b[0:4]), net.IP(b[4:8]), sourceMac, destMac)
+}
+
+// the sender ip as netip address, not valid if it is not set
+func (p *ARPPacket) SenderAddr() netip.Addr {
+	a, _ := netip.AddrFromSlice(p.SenderIp)
+	return a.Unmap()
+}
+
+// the target ip as netip address, not valid if it is not set
+func (p *ARPPacket) TargetAddr() netip.Addr {
+	a, _ := netip.AddrFromSlice(p.TargetIp)
+	return a.Unmap()
+}
+
 // malloc a byte slice with the packet details
 func (p *ARPPacket) Marshal() ([]byte, error) {
 	// 2 bytes for HardwareType
@@ -87,8 +173,20 @@ func (p *ARPPacket) Marshal() ([]byte, error) {
 	return b, nil
 }
 
-// Unmarshal a byte slice into arp packet struct
+// Unmarshal a byte slice into arp packet struct, the addresses are copied out of b
 func (p *ARPPacket) Unmarshal(b []byte) error {
+	if err := p.DecodeFromBytes(b); err != nil {
+		return err
+	}
+
+	// copy the addresses out, so the packet does not point into the (possibly reused) read buffer
+	p.copyAddrs()
+	return nil
+}
+
+// decode the packet without copying, the addresses point into b,
+// so they are only valid until b is reused (Clone the packet or use Unmarshal to keep them)
+func (p *ARPPacket) DecodeFromBytes(b []byte) error {
 	if len(b) < 8 {
 		return io.ErrUnexpectedEOF
 	}
@@ -96,16 +194,14 @@ func (p *ARPPacket) Unmarshal(b []byte) error {
 	p.HardwareType = binary.BigEndian.Uint16(b[0:2])
 	p.ProtocolType = binary.BigEndian.Uint16(b[2:4])
 
-	// p.HardwareAddrLength = b[4]
-	fmt.Println("Warning: invalid hardware addr length, defaulting to 6")
-	p.HardwareAddrLength = uint8(6)
+	p.HardwareAddrLength = b[4]
 	if p.HardwareAddrLength == 0 {
-		fmt.Println("Warning: invalid hardware addr length, defaulting to 6")
+		logger().Debug("invalid arp hardware addr length, defaulting to 6")
 		p.HardwareAddrLength = uint8(6)
 	}
 	p.ProtocolLength = b[5]
 	if p.ProtocolLength == 0 {
-		fmt.Println("Warning: invalid ip length, defaulting to 4")
+		logger().Debug("invalid arp ip length, defaulting to 4")
 		p.ProtocolLength = uint8(4)
 	}
 
@@ -129,78 +225,86 @@ func (p *ARPPacket) Unmarshal(b []byte) error {
 
 	// fmt.Printf("ARPLen: %d, Total Bytes: %d\n", arplen, len(b))
 
-	bb := make([]byte, arplen-n)
-
-	// sender mac
-	copy(bb[0:hlen], b[n:n+hlen])
-	p.SenderHardwareAddr = bb[0:hlen]
-	n += hlen
-
-	// sender ip
-	copy(bb[hlen:hlen+plen], b[n:n+plen])
-	senderIp := b[n : n+plen]
-
-	// fmt.Printf("Sender IP bytes: %x\n", senderIp)
+	p.SenderHardwareAddr = net.HardwareAddr(b[n : n+hlen])
+	p.SenderIp = net.IP(b[n+hlen : n+hlen+plen])
+	p.TargetHardwareAddr = net.HardwareAddr(b[n+hlen+plen : n+hlen2+plen])
+	p.TargetIp = net.IP(b[n+hlen2+plen : arplen])
 
-	p.SenderIp = net.IP(senderIp)
-	n += plen
-
-	copy(bb[hlen+plen:hlen2+plen], b[n:n+plen])
-	p.TargetHardwareAddr = bb[hlen+plen : hlen2+plen]
-	n += plen
-
-	copy(bb[hlen2+plen:hlen2+plen2], b[n:n+plen])
-	tIp := bb[hlen2+plen : hlen2+plen2]
+	return nil
+}
 
-	p.TargetIp = net.IP(tIp)
+// a deep copy of the packet that does not point into the decoded buffer
+func (p *ARPPacket) Clone() *ARPPacket {
+	c := *p
+	c.copyAddrs()
+	return &c
+}
 
-	return nil
+// move all the addresses into one new allocation
+func (p *ARPPacket) copyAddrs() {
+	hlen, plen := len(p.SenderHardwareAddr), len(p.SenderIp)
+	bb := make([]byte, 0, 2*hlen+2*plen)
+	bb = append(bb, p.SenderHardwareAddr...)
+	bb = append(bb, p.SenderIp...)
+	bb = append(bb, p.TargetHardwareAddr...)
+	bb = append(bb, p.TargetIp...)
+
+	p.SenderHardwareAddr = net.HardwareAddr(bb[0:hlen:hlen])
+	p.SenderIp = net.IP(bb[hlen : hlen+plen : hlen+plen])
+	p.TargetHardwareAddr = net.HardwareAddr(bb[hlen+plen : 2*hlen+plen : 2*hlen+plen])
+	p.TargetIp = net.IP(bb[2*hlen+plen:])
 }
 
+// decode the arp frame, the returned packet and header are copies that do not point into b
 func parsePacket(b []byte) (*ARPPacket, *EthernetHeader, error) {
-	fr := new(EthernetHeader)
-	err := fr.Unmarshal(b)
-	if err != nil {
+	var eth EthernetHeader
+	if err := eth.DecodeFromBytes(b); err != nil {
 		return nil, nil, err
 	}
-	// fmt.Println("Unmarshalled the frame")
-
-	if fr.EtherType != ARP_PROTOCOL {
-		return nil, nil, fmt.Errorf("Invalid ARP packet")
+	if eth.EtherType != ARP_PROTOCOL {
+		return nil, nil, ErrInvalidARPPacket
 	}
 
-	// unmarshal the sent payload into the new packet
-	p := new(ARPPacket)
-	err = p.Unmarshal(fr.Payload)
-	if err != nil {
+	var p ARPPacket
+	if err := p.DecodeFromBytes(eth.Payload); err != nil {
+		// the frame is arp, but the packet in it is broken
 		return nil, nil, err
 	}
 	// fmt.Println("Unmarshalled the packet")
 
-	return p, fr, nil
+	return p.Clone(), eth.Clone(), nil
 }
 
 // receive and read an arp packet and return it with its ethernet header
 func (c *Client) ReceiveARP() (*ARPPacket, *EthernetHeader, error) {
-	buf := make([]byte, 128)
+	bp := c.getFrameBuf()
+	defer putFrameBuf(bp)
+	buf := *bp
+
 	for {
-		n, _, err := c.Conn.ReadFrom(buf)
+		n, info, err := c.readFrame(buf)
 		if err != nil {
 			return nil, nil, err
 		}
-		fmt.Println("Read from the connection")
+		if c.skipTruncated(n, info) {
+			continue
+		}
 
 		// fmt.Println("Parsing packet")
 		// parsing just to the length read from
 		p, eth, err := parsePacket(buf[:n])
 		if err != nil {
 			// if the packet is just invalid, continue
-			if err == fmt.Errorf("Invalid ARP packet") {
+			if errors.Is(err, ErrInvalidARPPacket) {
+				c.counters.rejected.Add(1)
+				c.logger().Debug("skipping non arp frame", "len", n)
 				continue
 			}
+			c.counters.malformed.Add(1)
 			return nil, nil, err
 		}
-		// fmt.Println("Parsed the packet")
+		c.counters.parsed.Add(1)
+		c.logger().Debug("received arp packet", "op", p.Operation, "sender_ip", p.SenderIp, "sender_mac", p.SenderHardwareAddr, "target_ip", p.TargetIp)
 		return p, eth, nil
 	}
 }
@@ -0,0 +1,218 @@
+package netlibk
+
+import (
+	"io"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// how many arp requests the scan sends with one syscall
+const scanBatchSize = 64
+
+// one frame of a batch read or write
+type Message struct {
+	Buffer []byte
+	// the length of the frame read into the buffer, or how much of the buffer was written
+	N int
+	// what the kernel told about the read frame, the timestamp is set only with ListenTimestamps or the rx ring
+	Info FrameInfo
+	// the sender of a read frame, or where to send a written one, a cooked socket needs it for every frame
+	// as the kernel builds the link layer header from it, the frames of a raw socket carry their own destination
+	Addr *Address
+}
+
+// a connection that can read and write more frames with one syscall, RawConn is one
+type BatchConn interface {
+	ReadBatch(ms []Message) (int, error)
+	WriteBatch(ms []Message) (int, error)
+}
+
+// struct mmsghdr, x/sys has only the single msghdr
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// read up to len(ms) frames with one recvmmsg syscall, returns how many messages were filled in
+// it waits (until the read deadline) only for the first frame and then takes what is already queued
+func (rc *RawConn) ReadBatch(ms []Message) (int, error) {
+	if len(ms) == 0 {
+		return 0, nil
+	}
+
+	if rc.rx != nil {
+		return rc.readRingBatch(ms)
+	}
+
+	hdrs, err := newMmsghdrs(ms)
+	if err != nil {
+		return 0, err
+	}
+	names := make([]unix.RawSockaddrLinklayer, len(ms))
+	for i := range hdrs {
+		hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+		hdrs[i].hdr.Namelen = unix.SizeofSockaddrLinklayer
+	}
+
+	var oob []byte
+	if rc.readsMsg() {
+		oob = make([]byte, oobSpace*len(ms))
+		for i := range hdrs {
+			hdrs[i].hdr.Control = &oob[i*oobSpace]
+			hdrs[i].hdr.SetControllen(oobSpace)
+		}
+	}
+
+	var n int
+	err = rc.read(func(fd int) error {
+		var err error
+		n, err = mmsg(unix.SYS_RECVMMSG, fd, hdrs, unix.MSG_WAITFORONE|unix.MSG_TRUNC)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for i := 0; i < n; i++ {
+		// the length is of the whole frame (MSG_TRUNC), not only of what fit into the buffer
+		ms[i].Info = FrameInfo{Length: int(hdrs[i].len)}
+		ms[i].N = min(int(hdrs[i].len), len(ms[i].Buffer))
+		ms[i].Addr = rawLinkAddress(&names[i])
+		if oob != nil {
+			cmsgs := oob[i*oobSpace : i*oobSpace+int(hdrs[i].hdr.Controllen)]
+			ms[i].N = readControl(ms[i].Buffer, ms[i].N, cmsgs, &ms[i].Info)
+		}
+		ms[i].Info.Truncated = ms[i].Info.Length > ms[i].N
+	}
+
+	return n, nil
+}
+
+// take the frames already in the ring, waiting only for the first one
+func (rc *RawConn) readRingBatch(ms []Message) (int, error) {
+	read := 0
+	err := rc.read(func(fd int) error {
+		for read < len(ms) {
+			n, from, info, err := rc.nextRing(ms[read].Buffer)
+			if err == unix.EAGAIN {
+				if read > 0 {
+					return nil
+				}
+				return socketError(fd)
+			}
+			if err != nil {
+				return err
+			}
+			ms[read].N, ms[read].Info, ms[read].Addr = n, info, from
+			read++
+		}
+		return nil
+	})
+	return read, err
+}
+
+// write the frames with sendmmsg, the kernel may take only a part of the batch
+// so it is called until all of them are sent, returns how many were sent
+// a message with an address is sent to it, on a cooked socket every message needs one
+func (rc *RawConn) WriteBatch(ms []Message) (int, error) {
+	if len(ms) == 0 {
+		return 0, nil
+	}
+
+	if rc.tx != nil {
+		return rc.writeRingBatch(ms)
+	}
+
+	hdrs, err := newMmsghdrs(ms)
+	if err != nil {
+		return 0, err
+	}
+	names := make([]unix.RawSockaddrLinklayer, len(ms))
+	for i := range ms {
+		if ms[i].Addr == nil {
+			if rc.Cooked() {
+				return 0, ErrInvalidAddr
+			}
+			continue
+		}
+		if names[i], err = ms[i].Addr.rawSockaddr(rc.ifIndex, rc.protocol); err != nil {
+			return 0, err
+		}
+		hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&names[i]))
+		hdrs[i].hdr.Namelen = unix.SizeofSockaddrLinklayer
+	}
+
+	sent := 0
+	for sent < len(hdrs) {
+		var n int
+		err := rc.write(func(fd int) error {
+			var err error
+			n, err = mmsg(unix.SYS_SENDMMSG, fd, hdrs[sent:], 0)
+			return err
+		})
+		if err != nil {
+			return sent, err
+		}
+		for i := sent; i < sent+n; i++ {
+			ms[i].N = int(hdrs[i].len)
+		}
+		sent += n
+	}
+
+	return sent, nil
+}
+
+// queue all the frames into the tx ring and send them with one flush
+// the tx ring is only on the raw sockets, the frames carry their destination so the addresses are not used
+// when a frame can not be queued the ones before it are still flushed, the count is of the queued frames,
+// when the flush fails they stay queued in the ring and go out with the next flush
+func (rc *RawConn) writeRingBatch(ms []Message) (int, error) {
+	queued := 0
+	var err error
+	for queued < len(ms) {
+		if err = rc.QueueFrame(ms[queued].Buffer); err != nil {
+			break
+		}
+		ms[queued].N = len(ms[queued].Buffer)
+		queued++
+	}
+
+	if queued > 0 {
+		if ferr := rc.Flush(); err == nil {
+			err = ferr
+		}
+	}
+	return queued, err
+}
+
+// one header with one iovec for every message buffer
+func newMmsghdrs(ms []Message) ([]mmsghdr, error) {
+	hdrs := make([]mmsghdr, len(ms))
+	iovs := make([]unix.Iovec, len(ms))
+	for i := range ms {
+		if len(ms[i].Buffer) == 0 {
+			return nil, io.ErrShortBuffer
+		}
+		iovs[i].Base = &ms[i].Buffer[0]
+		iovs[i].SetLen(len(ms[i].Buffer))
+
+		hdrs[i].hdr.Iov = &iovs[i]
+		hdrs[i].hdr.SetIovlen(1)
+	}
+	return hdrs, nil
+}
+
+// call recvmmsg or sendmmsg on the headers, returns how many messages went through
+func mmsg(trap uintptr, fd int, hdrs []mmsghdr, flags int) (int, error) {
+	for {
+		n, _, errno := unix.Syscall6(trap, uintptr(fd), uintptr(unsafe.Pointer(&hdrs[0])), uintptr(len(hdrs)), uintptr(flags), 0, 0)
+		if errno == unix.EINTR {
+			continue
+		}
+		if errno != 0 {
+			return 0, errno
+		}
+		return int(n), nil
+	}
+}
@@ -1,10 +1,14 @@
 package netlibk
 
 import (
+	"errors"
 	"fmt"
+	"log/slog"
 	"net"
+	"net/netip"
 	"os"
-	"syscall"
+	"sync"
+	"time"
 )
 
 type Client struct {
@@ -12,11 +16,37 @@ type Client struct {
 	Conn               net.PacketConn
 	SourceIp           net.IP
 	SourceHardwareAddr net.HardwareAddr
-	EthernetHeader     *EthernetHeader
-	IPv4Header         *IPv4Header
+	// every address (with its subnet) assigned to the interface, including the secondary ones
+	// the sender ip for a request is picked from the prefix that contains the target
+	Prefixes       []netip.Prefix
+	EthernetHeader *EthernetHeader
+	IPv4Header     *IPv4Header
 
 	ICMP_ID    uint16
 	ICMPSeqNum uint16
+
+	// where the client writes its diagnostics
+	Logger *slog.Logger
+	// how long to wait for a reply, zero means to wait forever
+	Timeout time.Duration
+	// how many times to resend a request that timed out
+	Retries int
+	// the vlan tags put on every sent frame
+	VLANs []VLANTag
+
+	// size of the buffer for a single received frame
+	frameSize int
+	// when the echo request of every sequence number was sent, for the rtt of its reply
+	sentAt map[uint16]time.Time
+	sentMu sync.Mutex
+	// the macs of the neighbors resolved for the ip packets, by ResolveMAC6 and for the IPv4 next hops
+	neighbors neighborCache
+	// the source ip was given with WithSourceIP, so it is not picked by the prefixes
+	sourceSet bool
+	// the client on an arp socket that resolves the IPv4 next hops, when the client socket does not get the arp frames
+	arp *Client
+	// what happened to the received frames, see Stats
+	counters frameCounters
 }
 
 // func ICMPSetClientWhenInvalid(ifi *net.Interface, ip netip.Addr) (*Client, error) {
@@ -30,23 +60,14 @@ type Client struct {
 
 func ICMPSetClient(ifi *net.Interface) (*Client, error) {
 	// conn, err := Listen(ifi, syscall.SOCK_RAW, syscall.IPPROTO_ICMP)
-	conn, err := Listen(ifi, syscall.SOCK_RAW, int(IPv4_PROTOCOL))
-	if err != nil {
-		return nil, fmt.Errorf("Error opening connection for the net interface: %v\n", err)
-	}
-	return New(ifi, conn)
-
+	return NewClient(ifi, WithProtocol(IPv4_PROTOCOL))
 }
 
 func ARPSetClient(ifi *net.Interface) (*Client, error) {
 	// for now using the "ethernet" but I want to have something for non ethernet also
 	// I found that it probably won't work through wifi
 	// conn, err := net.ListenPacket("ethernet", ifi.Name)
-	conn, err := Listen(ifi, syscall.SOCK_RAW, int(ARP_PROTOCOL))
-	if err != nil {
-		return nil, fmt.Errorf("Error opening connection for the net interface: %v\n", err)
-	}
-	return New(ifi, conn)
+	return NewClient(ifi, WithProtocol(ARP_PROTOCOL))
 }
 
 // create a new client using the network interface and packet connection
@@ -63,29 +84,69 @@ func New(ifi *net.Interface, conn net.PacketConn) (*Client, error) {
 
 // func newClient(ifi *net.Interface, conn net.PacketConn, addrs []netip.Addr) (*Client, error) {
 func newClient(ifi *net.Interface, conn net.PacketConn, addrs []net.Addr) (*Client, error) {
-	ip, err := getIPv4Addr(addrs)
-	if err != nil {
-		return nil, err
+	return buildClient(ifi, conn, addrs, defaultConfig())
+}
+
+// make the client from the connection and the config, the options override what is taken from the interface
+func buildClient(ifi *net.Interface, conn net.PacketConn, addrs []net.Addr, cfg *clientConfig) (*Client, error) {
+	prefixes := getPrefixes(addrs)
+
+	ip := cfg.sourceIp
+	if ip == nil {
+		var err error
+		ip, err = getIPv4Addr(addrs)
+		// an IPv6 only interface can still be used for the neighbor discovery
+		if err != nil && !hasIPv6(prefixes) {
+			return nil, err
+		}
 	}
 
 	sourceMac := ifi.HardwareAddr
+	if cfg.sourceMac != nil {
+		sourceMac = cfg.sourceMac
+	}
 
 	// BuildEthernetHeader(sourceMac, )
 
+	frameSize := cfg.frameSize
+	if frameSize <= 0 {
+		frameSize = frameSizeForMTU(ifi.MTU)
+	}
+
+	icmpId := cfg.icmpId
+	if !cfg.icmpIdSet {
+		// unique id based on process id
+		icmpId = uint16(os.Getpid() & 0xffff)
+	}
+
 	return &Client{
 		Iface:              ifi,
 		Conn:               conn,
 		SourceIp:           ip,
 		SourceHardwareAddr: sourceMac,
+		Prefixes:           prefixes,
 
-		// unique id based on process id
-		ICMP_ID:    uint16(os.Getpid() & 0xffff),
-		ICMPSeqNum: 1,
+		ICMP_ID:    icmpId,
+		ICMPSeqNum: cfg.icmpSeq,
+
+		Logger:  cfg.logger,
+		Timeout: cfg.timeout,
+		Retries: cfg.retries,
+		VLANs:   cfg.vlans,
+
+		sourceSet: cfg.sourceIp != nil,
+		frameSize: frameSize,
 	}, nil
 }
 
 func (c *Client) Close() error {
-	return c.Conn.Close()
+	err := c.Conn.Close()
+	if c.arp != nil {
+		if aerr := c.arp.Close(); err == nil {
+			err = aerr
+		}
+	}
+	return err
 }
 
 // func getIPv4Addr(addrs []netip.Addr) (netip.Addr, error) {
@@ -111,6 +172,115 @@ func getIPv4Addr(addrs []net.Addr) (net.IP, error) {
 	return nil, fmt.Errorf("No valid IPv4 address")
 }
 
+// get all the addresses with their subnets from the interface addresses
+func getPrefixes(addrs []net.Addr) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if !ok || ipNet.IP == nil {
+			continue
+		}
+
+		ip, ok := netip.AddrFromSlice(ipNet.IP)
+		if !ok {
+			continue
+		}
+		// the ipv4 addresses can come in the 16 byte form, so unmap them to get the right prefix bits
+		ip = ip.Unmap()
+		ones, _ := ipNet.Mask.Size()
+
+		prefixes = append(prefixes, netip.PrefixFrom(ip, ones))
+	}
+
+	return prefixes
+}
+
+func hasIPv6(prefixes []netip.Prefix) bool {
+	for _, p := range prefixes {
+		if p.Addr().Is6() {
+			return true
+		}
+	}
+	return false
+}
+
+// the client source ip as netip address
+func (c *Client) SourceAddr() netip.Addr {
+	a, _ := netip.AddrFromSlice(c.SourceIp)
+	return a.Unmap()
+}
+
+// pick the sender ip for the given target, so the one on the same subnet as the target
+// if no prefix contains the target, it falls back to the client source ip
+// the source ip given with WithSourceIP is used for every IPv4 target
+func (c *Client) sourceAddrFor(target netip.Addr) netip.Addr {
+	if c.sourceSet && target.Is4() {
+		return c.SourceAddr()
+	}
+	for _, p := range c.Prefixes {
+		if p.Contains(target) {
+			return p.Addr()
+		}
+	}
+
+	return c.SourceAddr()
+}
+
+// set the read deadline for the reply if the client has a timeout
+func (c *Client) setReplyDeadline() error {
+	if c.Timeout <= 0 {
+		return nil
+	}
+	return c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+}
+
+// set the read deadline for collecting the replies until the scan wait is over, the returned func
+// leaves the deadline as the other receives expect it: with a timeout each of them sets its own, without one it is cleared
+func (c *Client) setCollectDeadline() (func(), error) {
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.scanWait())); err != nil {
+		return nil, err
+	}
+	return func() {
+		if c.Timeout <= 0 {
+			c.Conn.SetReadDeadline(time.Time{})
+		}
+	}, nil
+}
+
+// size of the buffer to read a frame into, the client may be made without NewClient so fall back to the interface MTU
+func (c *Client) bufSize() int {
+	if c.frameSize <= 0 {
+		if c.Iface != nil {
+			return frameSizeForMTU(c.Iface.MTU)
+		}
+		return defaultFrameSize
+	}
+	return c.frameSize
+}
+
+// the read buffers of the receive functions, so every receive does not allocate a new one
+var framePool = sync.Pool{
+	New: func() any {
+		b := make([]byte, defaultFrameSize)
+		return &b
+	},
+}
+
+// a pooled buffer of the client frame size, give it back with putFrameBuf
+func (c *Client) getFrameBuf() *[]byte {
+	bp := framePool.Get().(*[]byte)
+	if n := c.bufSize(); cap(*bp) < n {
+		*bp = make([]byte, n)
+	} else {
+		*bp = (*bp)[:n]
+	}
+	return bp
+}
+
+func putFrameBuf(bp *[]byte) {
+	framePool.Put(bp)
+}
+
 func (c *Client) HardwareAddr() net.HardwareAddr {
 	return c.Iface.HardwareAddr
 }
@@ -121,31 +291,89 @@ func (c *Client) Write(p *ARPPacket, addr net.HardwareAddr) error {
 		return err
 	}
 
-	et := &EthernetHeader{
-		DestAddr:   addr,                 // 6 bytes
-		SourceAddr: c.SourceHardwareAddr, // 6 bytes
-		EtherType:  ARP_PROTOCOL,         // 2 bytes
-		Payload:    payload,              // N bytes
+	return c.writeFrame(addr, ARP_PROTOCOL, payload)
+}
+
+// wrap the payload into an ethernet frame from the client and send it to the hardware address
+func (c *Client) writeFrame(addr net.HardwareAddr, etherType EtherType, payload []byte) error {
+	if c.cooked() {
+		return c.writeCooked(addr, etherType, payload)
 	}
 
-	// I guess I need to implement reading the data from the struct into bytes
-	b, err := et.Marshal()
+	b, err := c.buildFrame(addr, etherType, payload)
 	if err != nil {
 		return err
 	}
 
 	// because I want to write the payload to the address I need to first make the payload by marshalling
-	_, err = c.Conn.WriteTo(b, &Address{HardwareAddr: addr})
+	_, err = c.Conn.WriteTo(b, &Address{HardwareAddr: addr, Protocol: etherType})
 	return err
 }
 
+// the ethernet frame from the client to the hardware address with the payload
+func (c *Client) buildFrame(addr net.HardwareAddr, etherType EtherType, payload []byte) ([]byte, error) {
+	et := &EthernetHeader{
+		DestAddr:   addr,                 // 6 bytes
+		SourceAddr: c.SourceHardwareAddr, // 6 bytes
+		VLANs:      c.VLANs,              // 4 bytes each
+		EtherType:  etherType,            // 2 bytes
+		Payload:    payload,              // N bytes
+	}
+
+	// I guess I need to implement reading the data from the struct into bytes
+	return et.Marshal()
+}
+
 func (c *Client) ResolveMAC(targetIp net.IP, loop bool) (net.HardwareAddr, error) {
-	err := c.ARPRequest(targetIp)
+	target, ok := netip.AddrFromSlice(targetIp)
+	if !ok {
+		return nil, ErrInvalidIP
+	}
+	return c.ResolveMACAddr(target.Unmap(), loop)
+}
+
+// resolve the mac address of the target, but sending the request from the given source ip
+// instead of the one picked from the interface prefixes
+func (c *Client) ResolveMACFrom(targetIp, sourceIp net.IP, loop bool) (net.HardwareAddr, error) {
+	target, ok := netip.AddrFromSlice(targetIp)
+	if !ok {
+		return nil, ErrInvalidIP
+	}
+	source, ok := netip.AddrFromSlice(sourceIp)
+	if !ok {
+		return nil, ErrInvalidClient
+	}
+	return c.ResolveMACFromAddr(target.Unmap(), source.Unmap(), loop)
+}
+
+// same as ResolveMAC but with netip address
+func (c *Client) ResolveMACAddr(target netip.Addr, loop bool) (net.HardwareAddr, error) {
+	return c.ResolveMACFromAddr(target, c.sourceAddrFor(target), loop)
+}
+
+// same as ResolveMACFrom but with netip addresses
+func (c *Client) ResolveMACFromAddr(target, source netip.Addr, loop bool) (net.HardwareAddr, error) {
+	for attempt := 0; ; attempt++ {
+		mac, err := c.resolveMAC(target, source, loop)
+		// resend the request only when the reply did not come in time
+		if errors.Is(err, os.ErrDeadlineExceeded) && attempt < c.Retries {
+			continue
+		}
+		return mac, err
+	}
+}
+
+func (c *Client) resolveMAC(target, source netip.Addr, loop bool) (net.HardwareAddr, error) {
+	err := c.ARPRequestFromAddr(target, source)
 	if err != nil {
 		return nil, err
 	}
 	// fmt.Println("Sent the request")
 
+	if err = c.setReplyDeadline(); err != nil {
+		return nil, err
+	}
+
 	var count int = 0
 
 	// wait and get the replies
@@ -162,8 +390,7 @@ func (c *Client) ResolveMAC(targetIp net.IP, loop bool) (net.HardwareAddr, error
 		// fmt.Println("Reply received")
 
 		// fmt.Printf("Sender ip: %v; Target ip: %v\nOp: %v\n", arp.SenderIp, targetIp, arp.Operation)
-		if arp.Operation != OperationReply || CompareIPs(arp.SenderIp, targetIp) == 0 {
-			// if arp.SenderIp != targetIp {
+		if arp.Operation != OperationReply || arp.SenderAddr() != target {
 			count++
 			continue
 		}
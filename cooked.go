@@ -0,0 +1,85 @@
+package netlibk
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"time"
+)
+
+// the ethernet header the client puts in front of a cooked frame, so the same decoding works for it
+const cookedHdrLen = 14
+
+// a connection whose frames come without the link layer header, the cooked RawConn is one
+type cookedConn interface {
+	Cooked() bool
+}
+
+// whether the socket was opened with SockDatagram, so the frames have no link layer header
+func (rc *RawConn) Cooked() bool {
+	return rc.sockType == SockDatagram
+}
+
+func (c *Client) cooked() bool {
+	cc, ok := c.Conn.(cookedConn)
+	return ok && cc.Cooked()
+}
+
+// send the packet without a link layer header, the kernel builds it for the address and the ether type
+// the vlan tags are not used, open the client on the vlan interface instead
+func (c *Client) writeCooked(addr net.HardwareAddr, etherType EtherType, payload []byte) error {
+	_, err := c.Conn.WriteTo(payload, &Address{HardwareAddr: addr, Protocol: etherType})
+	return err
+}
+
+// read a cooked frame behind the space for an ethernet header and fill the header in from the sender address
+// only what the kernel tells is filled in: the destination is the interface mac for the frames sent to us,
+// broadcast for the broadcast ones and zero otherwise (multicast, outgoing, other hosts)
+// a conn that does not give an *Address leaves the whole header zero
+func (c *Client) readCooked(b []byte) (int, FrameInfo, error) {
+	if len(b) <= cookedHdrLen {
+		return 0, FrameInfo{}, io.ErrShortBuffer
+	}
+
+	var n int
+	var from net.Addr
+	var info FrameInfo
+	var err error
+	if rc, ok := c.Conn.(*RawConn); ok {
+		var a *Address
+		n, a, info, err = rc.readFrom(b[cookedHdrLen:])
+		if a != nil {
+			from = a
+		}
+	} else {
+		n, from, err = c.Conn.ReadFrom(b[cookedHdrLen:])
+		info = FrameInfo{Length: n}
+	}
+	if err != nil {
+		return 0, FrameInfo{}, err
+	}
+
+	clear(b[:cookedHdrLen])
+	if adr, ok := from.(*Address); ok {
+		switch adr.PacketType {
+		case PacketHost:
+			// not SourceHardwareAddr, that one can be set to something else than the interface has
+			if c.Iface != nil && len(c.Iface.HardwareAddr) == 6 {
+				copy(b[0:6], c.Iface.HardwareAddr)
+			}
+		case PacketBroadcast:
+			copy(b[0:6], EthernetBroadcast)
+		}
+		// a longer (or missing) hardware address does not fit, it is left zero
+		if len(adr.HardwareAddr) == 6 {
+			copy(b[6:12], adr.HardwareAddr)
+		}
+		binary.BigEndian.PutUint16(b[12:14], uint16(adr.Protocol))
+	}
+
+	if info.Timestamp.IsZero() {
+		info.Timestamp = time.Now()
+	}
+	info.Length += cookedHdrLen
+	return n + cookedHdrLen, info, nil
+}
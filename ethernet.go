@@ -6,18 +6,48 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"syscall"
-	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 // a custom implementation of net.PacketConn
 type RawConn struct {
-	fd            int
-	localAddr     net.Addr
-	mu            sync.Mutex // to protect deadlines
-	readDeadline  time.Time
-	writeDeadline time.Time
+	fd        int
+	ifIndex   int
+	hwAddrLen int       // of the interface, zero for the ones without hardware addresses (tun, ppp)
+	protocol  EtherType // the protocol the socket is bound to, for the sendto address
+	sockType  Type
+	localAddr net.Addr
+	mu        sync.Mutex
+	// set once by Close, the reads, writes and socket options return net.ErrClosed after it
+	closed atomic.Bool
+
+	// the non blocking socket in the go poller, all the reads and writes go through conn
+	// so they wait in the poller and the deadlines (kept by the file) wake them up
+	f    *os.File
+	conn syscall.RawConn
+
+	// the frames are read with recvmsg to get the stripped vlan tag from the aux data
+	// and the receive timestamps from the control messages
+	auxData    bool
+	timestamps timestampMode
+
+	// the memory mapped rings, nil when reading with recvfrom and writing with write,
+	// both are in the one mapping
+	ringMem []byte
+	rx      *rxRing
+	tx      *txRing
+	// who still uses the ring memory, the conn itself and a reserved tx slot,
+	// it is unmapped when the last one lets go of it (protected by mu)
+	ringRefs int
+	// the kernel counters summed up by Stats (protected by mu)
+	stats SocketStats
+	// the promiscuous and multicast memberships, dropped on close (protected by mu)
+	memberships []unix.PacketMreq
 }
 
 // Broadcast is a hardware address of a frame that should be sent to every device on given subnet
@@ -44,9 +74,10 @@ func (et *EthernetHeader) length() int {
 
 	// 6 bytes for destination mac addr
 	// 6 bytes for source mac addr
+	// 4 bytes for every vlan tag
 	// 2 bytes for ether type
 	// N bytes for payload length (possibly padded)
-	return 6 + 6 + 2 + pLen
+	return 6 + 6 + 4*len(et.VLANs) + 2 + pLen
 }
 
 // allocate a byte slice into the eth header / frame and make it to binary implementing the read func
@@ -57,54 +88,167 @@ func (et *EthernetHeader) Marshal() ([]byte, error) {
 	return b, err
 }
 
-// unmarshal byte slice into the ethernet header / frame
+// unmarshal byte slice into the ethernet header / frame, the addresses and payload are copied out of b
 func (et *EthernetHeader) Unmarshal(b []byte) error {
+	et.VLANs = nil
+	if err := et.DecodeFromBytes(b); err != nil {
+		return err
+	}
+
+	// now make a byte slice for the mac dest and source and the payload (mac + mac + payload = length)
+	bb := make([]byte, 6+6+len(et.Payload))
+	copy(bb[0:6], et.DestAddr)
+	et.DestAddr = bb[0:6]
+	copy(bb[6:12], et.SourceAddr)
+	et.SourceAddr = bb[6:12]
+
+	copy(bb[12:], et.Payload)
+	et.Payload = bb[12:]
+
+	return nil
+}
+
+// marshal the frame into b (like into a slot of the tx ring), returns the frame length
+func (et *EthernetHeader) MarshalTo(b []byte) (int, error) {
+	n := et.length()
+	if len(b) < n {
+		return 0, io.ErrShortBuffer
+	}
+
+	// the padding has to be zero, b may be reused
+	clear(b[:n])
+	return et.read(b[:n])
+}
+
+// decode the frame into the header without copying, the addresses and the payload point into b,
+// so they are only valid until b is reused (Clone the header or use Unmarshal to keep them)
+// the VLANs slice is reused, so decoding into the same header again does not allocate
+func (et *EthernetHeader) DecodeFromBytes(b []byte) error {
 	// 6 + 6 + 2 is the minimal size of the byte slice and then the payload length
 	if len(b) < 14 {
 		// return fmt.Errorf("Error byte slice of smaller size than 14")
 		return io.ErrUnexpectedEOF
 	}
 
-	n := 14
-	ethType := EtherType(binary.BigEndian.Uint16(b[n-2 : n]))
-	et.EtherType = ethType
+	n := 12
+	et.VLANs = et.VLANs[:0]
 
-	// now make a byte slice for the mac dest and source and the payload (mac + mac + payload = length)
-	bb := make([]byte, 6+6+len(b[n:]))
-	copy(bb[0:6], b[0:6])
-	et.DestAddr = bb[0:6]
-	copy(bb[6:12], b[6:12])
-	et.SourceAddr = bb[6:12]
+	// go through the vlan tags until the real ether type
+	ethType := EtherType(binary.BigEndian.Uint16(b[n : n+2]))
+	for isVLANProtocol(ethType) {
+		if len(b) < n+4+2 {
+			return io.ErrUnexpectedEOF
+		}
+		var tag VLANTag
+		tag.unmarshal(b[n : n+4])
+		et.VLANs = append(et.VLANs, tag)
 
-	copy(bb[12:], b[12:])
-	et.Payload = bb[12:]
+		n += 4
+		ethType = EtherType(binary.BigEndian.Uint16(b[n : n+2]))
+	}
+	et.EtherType = ethType
+
+	et.DestAddr = net.HardwareAddr(b[0:6])
+	et.SourceAddr = net.HardwareAddr(b[6:12])
+	et.Payload = b[n+2:]
 
 	return nil
 }
 
+// a deep copy of the header that does not point into the decoded buffer
+func (et *EthernetHeader) Clone() *EthernetHeader {
+	c := *et
+	c.VLANs = append([]VLANTag(nil), et.VLANs...)
+	c.DestAddr = append(net.HardwareAddr(nil), et.DestAddr...)
+	c.SourceAddr = append(net.HardwareAddr(nil), et.SourceAddr...)
+	c.Payload = append([]byte(nil), et.Payload...)
+	return &c
+}
+
 // make the binary form of a frame or eth header for the marshal to then allocate
 func (et *EthernetHeader) read(b []byte) (int, error) {
 	copy(b[0:6], et.DestAddr)
 	copy(b[6:12], et.SourceAddr)
 	n := 12
 
-	// for now I do not care about VLAN I guess I do not need it for goapt
+	for _, tag := range et.VLANs {
+		tag.marshal(b[n : n+4])
+		n += 4
+	}
 
 	binary.BigEndian.PutUint16(b[n:n+2], uint16(et.EtherType))
 	copy(b[n+2:], et.Payload)
 	return len(b), nil
 }
 
+// options applied to the socket when listening
+type listenConfig struct {
+	readBuffer  int
+	writeBuffer int
+	promisc     bool
+	auxData     bool
+	rxRing      *RingConfig
+	txRing      *RingConfig
+	qdiscBypass bool
+	timestamps  timestampMode
+	multicast   []net.HardwareAddr
+	allMulti    bool
+	fanout      *fanoutConfig
+}
+
+type ListenOption func(*listenConfig)
+
+// set the kernel socket receive and send buffer sizes (SO_RCVBUF / SO_SNDBUF), zero keeps the default
+func ListenBufferSizes(read, write int) ListenOption {
+	return func(lc *listenConfig) {
+		lc.readBuffer = read
+		lc.writeBuffer = write
+	}
+}
+
+// put the interface into promiscuous mode for as long as the socket is open
+func ListenPromiscuous() ListenOption {
+	return func(lc *listenConfig) {
+		lc.promisc = true
+	}
+}
+
+// join the multicast groups (by their mac addresses) for as long as the socket is open,
+// for the IPv6 groups the mac is from IPv6MulticastMAC
+func ListenMulticast(groups ...net.HardwareAddr) ListenOption {
+	return func(lc *listenConfig) {
+		lc.multicast = append(lc.multicast, groups...)
+	}
+}
+
+// receive the frames of all the multicast groups for as long as the socket is open
+func ListenAllMulticast() ListenOption {
+	return func(lc *listenConfig) {
+		lc.allMulti = true
+	}
+}
+
 // func Listen(ifi *net.Interface, socketType Type, protocol int) (net.PacketConn, error) {
-func Listen(ifi *net.Interface, socketType Type, protocol int) (*RawConn, error) {
+func Listen(ifi *net.Interface, socketType Type, protocol int, opts ...ListenOption) (*RawConn, error) {
 	// fmt.Printf("Protocol: 0x%04x, SocketType: %d\n", protocol, socketType)
 	var fd int
 	var err error
 
+	lc := new(listenConfig)
+	for _, opt := range opts {
+		opt(lc)
+	}
+
+	if socketType != SockRaw && socketType != SockDatagram {
+		return nil, ErrInvalidSocketType
+	}
+	if socketType == SockDatagram && lc.txRing != nil {
+		return nil, ErrCookedTxRing
+	}
+
 	// create socket
-	fd, err = syscall.Socket(syscall.AF_PACKET, int(socketType), int(htons(uint16(protocol))))
+	fd, err = syscall.Socket(syscall.AF_PACKET, int(socketType)|syscall.SOCK_NONBLOCK|syscall.SOCK_CLOEXEC, int(htons(uint16(protocol))))
 	if err != nil {
-		syscall.Close(fd)
 		return nil, fmt.Errorf("failed to create socket: %v\n", err)
 	}
 
@@ -119,23 +263,124 @@ func Listen(ifi *net.Interface, socketType Type, protocol int) (*RawConn, error)
 		return nil, fmt.Errorf("Error failed to bind socket: %v\n", err)
 	}
 
+	rc := &RawConn{fd: fd, ifIndex: ifi.Index, hwAddrLen: len(ifi.HardwareAddr), protocol: EtherType(protocol), sockType: socketType}
+	// the file owns the socket from here, Close closes it through the file
+	rc.f = os.NewFile(uintptr(fd), "packet")
+	if rc.conn, err = rc.f.SyscallConn(); err != nil {
+		rc.f.Close()
+		return nil, err
+	}
+	if err = lc.apply(rc); err != nil {
+		rc.Close()
+		return nil, err
+	}
+
 	addrs, err := ifi.Addrs()
 	if err != nil {
+		rc.Close()
 		return nil, fmt.Errorf("Error getting addresses from net interface: %v\n", err)
 	}
 
+	// prefer the IPv4 address, but an IPv6 only interface is fine too
 	ip, err := getIPv4Addr(addrs)
 	if err != nil {
-		return nil, fmt.Errorf("Error getting first IPv4 address: %v\n", err)
+		prefixes := getPrefixes(addrs)
+		if len(prefixes) == 0 {
+			rc.Close()
+			return nil, fmt.Errorf("Error getting an address of the net interface: %v\n", err)
+		}
+		ip = net.IP(prefixes[0].Addr().AsSlice())
+	}
+
+	var ringMem []byte
+	var rx *rxRing
+	var tx *txRing
+	if lc.rxRing != nil || lc.txRing != nil {
+		if ringMem, rx, tx, err = setupRings(fd, lc.rxRing, lc.txRing); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	rc.ringMem, rc.rx, rc.tx = ringMem, rx, tx
+	if ringMem != nil {
+		rc.ringRefs = 1
 	}
-	s := ip.To4()
 
-	return &RawConn{
-		fd: fd,
-		localAddr: &net.IPAddr{
-			IP: net.IP(s),
-		},
-	}, nil
+	// join the group last, the kernel takes the socket out of it while the rings are set up
+	if lc.fanout != nil {
+		if err = rc.control(lc.fanout.join); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+
+	rc.localAddr = &net.IPAddr{
+		IP: ip,
+	}
+	// a cooked frame has no link header to put the stripped vlan tag back into
+	rc.auxData = lc.auxData && socketType != SockDatagram
+	rc.timestamps = lc.timestamps
+
+	return rc, nil
+}
+
+// the read buffer size that fits a whole frame of the interface
+func (rc *RawConn) frameSize() int {
+	ifi, err := net.InterfaceByIndex(rc.ifIndex)
+	if err != nil {
+		return defaultFrameSize
+	}
+	return frameSizeForMTU(ifi.MTU)
+}
+
+// set the configured socket options on the bound socket
+func (lc *listenConfig) apply(rc *RawConn) error {
+	fd := rc.fd
+
+	if lc.readBuffer > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, lc.readBuffer); err != nil {
+			return fmt.Errorf("Error setting the socket read buffer: %v", err)
+		}
+	}
+	if lc.writeBuffer > 0 {
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_SNDBUF, lc.writeBuffer); err != nil {
+			return fmt.Errorf("Error setting the socket write buffer: %v", err)
+		}
+	}
+
+	if lc.auxData {
+		if err := syscall.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_AUXDATA, 1); err != nil {
+			return fmt.Errorf("Error enabling the packet aux data: %v", err)
+		}
+	}
+
+	if err := lc.timestamps.apply(fd); err != nil {
+		return err
+	}
+
+	if lc.qdiscBypass {
+		if err := syscall.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_QDISC_BYPASS, 1); err != nil {
+			return fmt.Errorf("Error enabling the qdisc bypass: %v", err)
+		}
+	}
+
+	if lc.promisc {
+		if err := rc.addMembership(unix.PACKET_MR_PROMISC, nil); err != nil {
+			return fmt.Errorf("Error enabling promiscuous mode: %v", err)
+		}
+	}
+	if lc.allMulti {
+		if err := rc.addMembership(unix.PACKET_MR_ALLMULTI, nil); err != nil {
+			return fmt.Errorf("Error enabling all multicast mode: %v", err)
+		}
+	}
+	for _, group := range lc.multicast {
+		if err := rc.JoinMulticast(group); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
 
 // htons converts a 16-bit value to big-endian
@@ -0,0 +1,149 @@
+package netlibk
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// how the kernel spreads the frames between the sockets of a fanout group
+type FanoutMode uint16
+
+const (
+	// by the flow hash, so all the frames of one flow go to the same socket
+	FanoutHash FanoutMode = unix.PACKET_FANOUT_HASH
+	// round robin over the sockets
+	FanoutLoadBalance FanoutMode = unix.PACKET_FANOUT_LB
+	// by the cpu the frame came in on
+	FanoutCPU FanoutMode = unix.PACKET_FANOUT_CPU
+	// fill one socket and go to the next one only when it is full
+	FanoutRollover FanoutMode = unix.PACKET_FANOUT_ROLLOVER
+)
+
+var ErrInvalidFanout = errors.New("Error invalid fanout group")
+
+type fanoutConfig struct {
+	id   uint16
+	mode FanoutMode
+}
+
+// join the fanout group with the id, the sockets on the same interface with the same id and mode
+// share the received frames between them instead of each getting a copy
+// the group lives in the network namespace, so pick an id other programs do not use
+func ListenFanout(id uint16, mode FanoutMode) ListenOption {
+	return func(lc *listenConfig) {
+		lc.fanout = &fanoutConfig{id: id, mode: mode}
+	}
+}
+
+// join the group, it has to be done after the bind and after the rings are set up
+func (f *fanoutConfig) join(fd int) error {
+	if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_FANOUT, int(f.id)|int(f.mode)<<16); err != nil {
+		return fmt.Errorf("Error joining the fanout group %d: %v", f.id, err)
+	}
+	return nil
+}
+
+// open n sockets on the interface in the same fanout group, the options are applied to every one of them
+func ListenFanoutGroup(ifi *net.Interface, socketType Type, protocol int, n int, id uint16, mode FanoutMode, opts ...ListenOption) ([]*RawConn, error) {
+	if n <= 0 {
+		return nil, ErrInvalidFanout
+	}
+
+	// clipped so the caller's backing array is never written to
+	opts = append(slices.Clip(opts), ListenFanout(id, mode))
+	conns := make([]*RawConn, 0, n)
+	for i := 0; i < n; i++ {
+		rc, err := Listen(ifi, socketType, protocol, opts...)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conns = append(conns, rc)
+	}
+
+	return conns, nil
+}
+
+// called by a worker for every decoded frame, worker is the index of the socket it came from
+// the packet layers point into the read buffer which is reused for the next frame,
+// so clone the layers that should be kept after the handler returns
+// info.Truncated tells the frame did not fit into the read buffer, the packet is only its start then
+type PacketHandler func(worker int, p Packet, info FrameInfo)
+
+// run one goroutine per socket that reads the frames, decodes them and passes them to the handler
+// it returns when the context is done or when a read fails, the error is the first read error
+// the sockets are not closed, that is left to the caller
+// with frameSize zero every worker reads into a buffer that fits a whole frame of the interface MTU
+func RunWorkers(ctx context.Context, conns []*RawConn, frameSize int, handle PacketHandler) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// a deadline in the past wakes up the blocked reads when the context is done,
+	// the deadlines are left cleared for whoever uses the sockets next
+	for _, rc := range conns {
+		if err := rc.SetReadDeadline(time.Time{}); err != nil {
+			return err
+		}
+	}
+	woken := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(woken)
+		for _, rc := range conns {
+			rc.SetReadDeadline(time.Unix(1, 0))
+		}
+	})
+	defer func() {
+		if !stop() {
+			<-woken
+		}
+		for _, rc := range conns {
+			rc.SetReadDeadline(time.Time{})
+		}
+	}()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+
+	for i, rc := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := runWorker(ctx, i, rc, frameSize, handle); err != nil {
+				once.Do(func() { firstErr = err })
+				cancel()
+			}
+		}()
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+func runWorker(ctx context.Context, worker int, rc *RawConn, frameSize int, handle PacketHandler) error {
+	if frameSize <= 0 {
+		frameSize = rc.frameSize()
+	}
+	b := make([]byte, frameSize)
+	for {
+		n, info, err := rc.ReadFrame(b)
+		if err != nil {
+			// woken up by the deadline set when the context was done
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("Error reading in fanout worker %d: %v", worker, err)
+		}
+
+		handle(worker, Decode(b[:n]), info)
+	}
+}
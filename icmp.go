@@ -3,10 +3,13 @@ package netlibk
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"os"
+	"slices"
 	"time"
 )
 
@@ -14,9 +17,13 @@ import (
 // or when you don't want to use client, so you want a higher level implementation (it is essentially easier to set up and run etc...)
 func HigherLvlPing(dest net.IP, payload []byte, timeout time.Duration) (time.Duration, bool, error) {
 	var seqN, icmpID uint16 = 1, uint16(os.Getpid() & 0xffff)
-	if dest == nil || dest.To4() == nil {
+	if dest == nil || dest.To16() == nil {
 		return 0, false, fmt.Errorf("invalid IP address")
 	}
+	if dest.To4() == nil {
+		d, _ := netip.AddrFromSlice(dest)
+		return HigherLvlPing6(d, payload, timeout)
+	}
 	// fmt.Printf("Connecting to %s\n", dest.String())
 
 	c, err := net.Dial("ip4:icmp", dest.String())
@@ -77,12 +84,46 @@ func HigherLvlPing(dest net.IP, payload []byte, timeout time.Duration) (time.Dur
 
 // ping the desired destination ip with payload and return the response time, active boolean and error
 func (c *Client) Ping(dest net.IP, payload []byte) (time.Duration, bool, error) {
-	err := c.SendICMP(dest, payload)
+	d, ok := netip.AddrFromSlice(dest)
+	if !ok {
+		return 0, false, ErrInvalidIP
+	}
+	return c.PingAddr(d.Unmap(), payload)
+}
+
+// same as Ping but with netip address
+func (c *Client) PingAddr(dest netip.Addr, payload []byte) (time.Duration, bool, error) {
+	// the IPv6 destinations are pinged with Ping6
+	if dest = dest.Unmap(); !dest.Is4() {
+		return 0, false, ErrInvalidIP
+	}
+	for attempt := 0; ; attempt++ {
+		t, active, err := c.ping(dest, payload)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// the cached mac of the next hop may be the reason there was no reply, resolve it again next time
+			if hop, err := c.nextHop(dest); err == nil {
+				c.neighbors.remove(hop)
+			}
+			// send another echo only when the reply did not come in time
+			if attempt < c.Retries {
+				continue
+			}
+		}
+		return t, active, err
+	}
+}
+
+func (c *Client) ping(dest netip.Addr, payload []byte) (time.Duration, bool, error) {
+	err := c.SendICMPAddr(dest, payload)
 	if err != nil {
 		return 0, false, err
 	}
 
-	_, t, active, err := c.ReceiveICMP()
+	if err = c.setReplyDeadline(); err != nil {
+		return 0, false, err
+	}
+
+	_, t, active, err := c.receiveEchoReply(dest)
 	if err != nil {
 		return 0, active, err
 	}
@@ -91,7 +132,7 @@ func (c *Client) Ping(dest net.IP, payload []byte) (time.Duration, bool, error)
 }
 
 func (icmp *ICMPPacket) Marshal() ([]byte, error) {
-	b := make([]byte, 128)
+	b := make([]byte, 8+len(icmp.Payload))
 	b[0] = icmp.Type
 	b[1] = icmp.Code
 	binary.BigEndian.PutUint16(b[2:4], icmp.Checksum)
@@ -102,7 +143,24 @@ func (icmp *ICMPPacket) Marshal() ([]byte, error) {
 	return b, nil
 }
 
+// unmarshal the icmp message, the payload is copied out of b
 func (icmp *ICMPPacket) Unmarshal(b []byte) error {
+	if err := icmp.DecodeFromBytes(b); err != nil {
+		return err
+	}
+
+	if len(icmp.Payload) > 0 {
+		icmp.Payload = append([]byte(nil), icmp.Payload...)
+	} else {
+		icmp.Payload = nil
+	}
+
+	return nil
+}
+
+// decode the icmp message without copying, the payload points into b,
+// so it is only valid until b is reused (Clone the packet or use Unmarshal to keep it)
+func (icmp *ICMPPacket) DecodeFromBytes(b []byte) error {
 	if len(b) < 8 {
 		return io.ErrUnexpectedEOF
 	}
@@ -116,41 +174,74 @@ func (icmp *ICMPPacket) Unmarshal(b []byte) error {
 
 	// fmt.Printf("Parsed ICMP: Type=%d, Code=%d, ID=%d, Seq=%d\n", icmp.Type, icmp.Code, icmp.Id, icmp.Seq)
 
-	if len(b) > 8 {
-		icmp.Payload = make([]byte, len(b)-8)
-		copy(b[8:], icmp.Payload)
-	} else {
-		icmp.Payload = nil
-	}
+	icmp.Payload = b[8:]
 
 	return nil
 }
 
+// a deep copy of the packet that does not point into the decoded buffer
+func (icmp *ICMPPacket) Clone() *ICMPPacket {
+	c := *icmp
+	c.Payload = append([]byte(nil), icmp.Payload...)
+	return &c
+}
+
+// send the icmp message in an IPv4 packet in a frame to the mac of the next hop on the link,
+// on a cooked socket the kernel adds the link layer header for the next hop
+func (c *Client) sendICMPFrame(mac net.HardwareAddr, dest netip.Addr, msg []byte) error {
+	hdr, err := BuildIPv4HeaderAddr(c.sourceAddrFor(dest), dest, uint16(ICMP_PROTOCOL), msg)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(mac, IPv4_PROTOCOL, append(hdr, msg...))
+}
+
 func (c *Client) SendICMP(dest net.IP, payload []byte) error {
+	d, ok := netip.AddrFromSlice(dest)
+	if !ok {
+		return ErrInvalidIP
+	}
+	return c.SendICMPAddr(d.Unmap(), payload)
+}
+
+// same as SendICMP but with netip address
+func (c *Client) SendICMPAddr(dest netip.Addr, payload []byte) error {
 	if c.SourceIp == nil {
 		return ErrInvalidClient
 	}
+	if dest = dest.Unmap(); !dest.Is4() {
+		return ErrInvalidIP
+	}
 	icmp, err := BuildICMPPacket(c.ICMPSeqNum, c.ICMP_ID, payload)
 	if err != nil {
 		return err
 	}
-	icmp.checksum(payload)
 	c.ICMPSeqNum++
 
-	p, err := icmp.Marshal()
-	if err != nil {
+	// the checksum covers the whole message, the header too
+	buf := NewSerializeBuffer()
+	if err := SerializeLayers(buf, SerializeOptions{ComputeChecksums: true}, icmp); err != nil {
 		return err
 	}
+	p := buf.Bytes()
 
 	// fmt.Printf("Raw Packet: %x\n", p)
 
 	// sockaddr := &syscall.SockaddrInet4{}
 	// copy(sockaddr.Addr[:], dest.To4())
 
-	_, err = c.Conn.WriteTo(p, &net.IPAddr{IP: dest})
+	// resolved before the send time is taken, so the arp for the next hop does not count into the rtt
+	mac, err := c.nextHopMAC(dest)
 	if err != nil {
+		return err
+	}
+
+	// marked before the write, on lo the reply can be received before the write returns
+	c.markSent(icmp.Seq)
+	if err := c.sendICMPFrame(mac, dest, p); err != nil {
 		return fmt.Errorf("Failed to send raw ICMP packet: %v\n", err)
 	}
+	c.logger().Debug("sent icmp echo", "dest", dest, "id", icmp.Id, "seq", icmp.Seq, "len", len(p))
 
 	// IF it doesn't work this way I can try to use the raw header and kernel configurations
 	// and all the syscall things
@@ -175,27 +266,62 @@ func (c *Client) SendICMP(dest net.IP, payload []byte) error {
 	return nil
 }
 
+// read until the echo reply to one of the client requests comes, with the rtt from when its request was sent
+// the other frames are skipped (and counted as rejected in Stats)
 func (c *Client) ReceiveICMP() (*ICMPPacket, time.Duration, bool, error) {
-	buf := make([]byte, 128)
-
-	start := time.Now()
-	n, _, err := c.Conn.ReadFrom(buf)
-	if err != nil {
-		return nil, 0, false, fmt.Errorf("Error reading from buffer when receiving icmp packet: %v\n", err)
-	}
+	return c.receiveEchoReply(netip.Addr{})
+}
 
-	icmp := &ICMPPacket{}
-	if err = icmp.Unmarshal(buf[:n]); err != nil {
-		return nil, 0, false, fmt.Errorf("Error unmarshalling: %v\n", err)
+// read until the echo reply to one of the client requests comes from the source, from anyone when it is not valid
+func (c *Client) receiveEchoReply(source netip.Addr) (*ICMPPacket, time.Duration, bool, error) {
+	bp := c.getFrameBuf()
+	defer putFrameBuf(bp)
+	buf := *bp
+
+	// the socket gets all of the ip traffic, the frames are decoded into these so skipping them does not allocate
+	var eth EthernetHeader
+	var ip IPv4Header
+	var p ICMPPacket
+	parser := NewDecodingLayerParser(LayerTypeEthernet, &eth, &ip, &p)
+	decoded := make([]LayerType, 0, 4)
+
+	for {
+		n, info, err := c.readFrame(buf)
+		if err != nil {
+			return nil, 0, false, fmt.Errorf("Error reading from buffer when receiving icmp packet: %w", err)
+		}
+		if c.skipTruncated(n, info) {
+			continue
+		}
+
+		if err := parser.DecodeLayers(buf[:n], &decoded); err != nil {
+			c.counters.malformed.Add(1)
+			c.logger().Debug("skipping malformed packet", "err", err)
+			continue
+		}
+
+		// only the echo replies (type 0) with our id, so not the other icmp messages, the replies to the other
+		// pings on the host or our own echo request that comes back when pinging through lo
+		if !slices.Contains(decoded, LayerTypeICMP) || p.Type != 0 || p.Id != c.ICMP_ID ||
+			(source.IsValid() && ip.SourceAddr() != source) {
+			c.counters.rejected.Add(1)
+			continue
+		}
+
+		// the rtt is from the send to the (kernel) receive time of the reply,
+		// without the time it took us to get to the reading
+		rtt, ok := c.rtt(p.Seq, info.Timestamp)
+		if !ok {
+			// not sent by this client, or a duplicate of a reply that already came
+			c.counters.rejected.Add(1)
+			continue
+		}
+		c.counters.parsed.Add(1)
+		c.logger().Debug("received icmp echo reply", "source", ip.SourceAddr(), "id", p.Id, "seq", p.Seq, "rtt", rtt)
+
+		// the buffer goes back to the pool, so keep a copy
+		return p.Clone(), rtt, true, nil
 	}
-
-	// check whether ids are correct and the type is response (0)
-	// fmt.Printf("ID: %v : %v\nTYPE: %v\n", icmp.Id, c.ICMP_ID, icmp.Type)
-	// if icmp.Id != c.ICMP_ID || icmp.Type != 0 {
-	// 	return nil, 0, false, fmt.Errorf("Error unexpected icmp response packet\n")
-	// }
-
-	return icmp, time.Since(start), true, nil
 }
 
 func BuildICMPPacket(seq, id uint16, payload []byte) (*ICMPPacket, error) {
@@ -208,25 +334,6 @@ func BuildICMPPacket(seq, id uint16, payload []byte) (*ICMPPacket, error) {
 	}, nil
 }
 
-func (icmp *ICMPPacket) checksum(data []byte) {
-	var sum uint32
-
-	// converting, shifting the bits and the "|" is a bitwise OR to combine those two 8-bit values into one 16 bit val
-	for i := 0; i < len(data)-1; i += 2 {
-		sum += uint32(data[i])<<8 | uint32(data[i+1])
-	}
-	if len(data)%2 == 1 {
-		sum += uint32(data[len(data)-1]) << 8
-	}
-	// ensuring no overflown bits remain there, extracting them and adding them to the lower 16 bits
-	sum = (sum >> 16) + (sum & 0xffff)
-	sum += (sum >> 16)
-
-	// one's complement -> inverts all bits so 0 to 1 and 1 to 0
-	icmp.Checksum = uint16(^sum)
-	// return uint16(^sum)
-}
-
 func (icmp *ICMP) checksum(data []byte) {
 	var sum uint32
 
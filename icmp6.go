@@ -0,0 +1,248 @@
+package netlibk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// default hop limit of the echo requests
+const defaultHopLimit = 64
+
+// ping6 for when the raw Ping6 is not usable, the IPv6 version of HigherLvlPing (uses the standard library socket)
+// a link-local destination needs its zone, like fe80::1%eth0
+func HigherLvlPing6(dest netip.Addr, payload []byte, timeout time.Duration) (time.Duration, bool, error) {
+	var seqN, icmpID uint16 = 1, uint16(os.Getpid() & 0xffff)
+	if !dest.Is6() || dest.Is4In6() {
+		return 0, false, fmt.Errorf("invalid IPv6 address")
+	}
+
+	c, err := net.Dial("ip6:ipv6-icmp", dest.String())
+	if err != nil {
+		return 0, false, fmt.Errorf("could not connect: %v", err)
+	}
+	defer c.Close()
+
+	icmp, _ := BuildICMPPacket(seqN, icmpID, payload)
+	icmp.Type = ICMPv6EchoRequest
+	// the kernel fills in the ICMPv6 checksum on the raw socket, it knows the pseudo header
+	packet, err := icmp.Marshal()
+	if err != nil {
+		return 0, false, err
+	}
+
+	start := time.Now()
+	if _, err := c.Write(packet); err != nil {
+		return 0, false, fmt.Errorf("Error sending packet: %v", err)
+	}
+
+	reply := make([]byte, 1024)
+	c.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		// the IPv6 socket gives just the ICMPv6 message without the IP header,
+		// and every ICMPv6 message from the destination, so wait for the echo reply
+		n, err := c.Read(reply)
+		if err != nil {
+			return 0, false, fmt.Errorf("Error reading reply: %v", err)
+		}
+		if n < 8 || reply[0] != ICMPv6EchoReply {
+			continue
+		}
+
+		replyID := binary.BigEndian.Uint16(reply[4:6])
+		replySeq := binary.BigEndian.Uint16(reply[6:8])
+		// the replies to the other pings running on the host come here too
+		if replyID != icmp.Id || replySeq != icmp.Seq {
+			continue
+		}
+
+		return time.Since(start), true, nil
+	}
+}
+
+// ping the IPv6 destination through the raw socket, the IPv6 version of Ping
+// the client has to be made with WithProtocol(IPv6_PROTOCOL), the mac of the destination is resolved with ResolveMAC6
+// and kept in the client's neighbor cache, so the following pings to it do not solicit again
+func (c *Client) Ping6(dest netip.Addr, payload []byte) (time.Duration, bool, error) {
+	for attempt := 0; ; attempt++ {
+		t, active, err := c.ping6(dest, payload)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// the cached mac may be the reason there was no reply, resolve it again next time
+			c.neighbors.remove(dest)
+			// send another echo only when the reply did not come in time
+			if attempt < c.Retries {
+				continue
+			}
+		}
+		return t, active, err
+	}
+}
+
+func (c *Client) ping6(dest netip.Addr, payload []byte) (time.Duration, bool, error) {
+	if !dest.Is6() {
+		return 0, false, ErrInvalidIP
+	}
+	src, err := c.sourceAddr6For(dest)
+	if err != nil {
+		return 0, false, err
+	}
+
+	mac := IPv6MulticastMAC(dest)
+	if !dest.IsMulticast() {
+		if mac, err = c.neighborMAC(dest); err != nil {
+			return 0, false, err
+		}
+	}
+
+	icmp, err := BuildICMPPacket(c.ICMPSeqNum, c.ICMP_ID, payload)
+	if err != nil {
+		return 0, false, err
+	}
+	icmp.Type = ICMPv6EchoRequest
+	c.ICMPSeqNum++
+
+	msg, err := icmp.Marshal()
+	if err != nil {
+		return 0, false, err
+	}
+
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.scanWait())); err != nil {
+		return 0, false, err
+	}
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	// marked before the write, on lo the reply can be received before the write returns
+	c.markSent(icmp.Seq)
+	if err := c.writeICMPv6(mac, src, dest, defaultHopLimit, msg); err != nil {
+		return 0, false, fmt.Errorf("Failed to send ICMPv6 echo: %v", err)
+	}
+	c.logger().Debug("sent icmpv6 echo", "dest", dest, "id", icmp.Id, "seq", icmp.Seq)
+
+	for {
+		ip6, _, info, err := c.receiveICMPv6(ICMPv6EchoReply)
+		if err != nil {
+			return 0, false, err
+		}
+
+		reply := new(ICMPPacket)
+		if err := reply.Unmarshal(ip6.Payload); err != nil {
+			continue
+		}
+		if reply.Id != icmp.Id || reply.Seq != icmp.Seq {
+			continue
+		}
+		if !dest.IsMulticast() && ip6.SourceIp != dest.WithZone("") {
+			continue
+		}
+
+		// a duplicate of the reply that already came has no send time anymore
+		rtt, ok := c.rtt(reply.Seq, info.Timestamp)
+		if !ok {
+			continue
+		}
+		c.logger().Debug("received icmpv6 echo reply", "source", ip6.SourceIp, "id", reply.Id, "seq", reply.Seq)
+		return rtt, true, nil
+	}
+}
+
+// fill in the checksum of the ICMPv6 message and send it in an IPv6 packet to the hardware address
+func (c *Client) writeICMPv6(addr net.HardwareAddr, src, dst netip.Addr, hopLimit uint8, msg []byte) error {
+	binary.BigEndian.PutUint16(msg[2:4], 0)
+	binary.BigEndian.PutUint16(msg[2:4], ICMPv6Checksum(src, dst, msg))
+
+	ip6, err := BuildIPv6Header(src, dst, ICMPv6_PROTOCOL, hopLimit, msg)
+	if err != nil {
+		return err
+	}
+	b, err := ip6.Marshal()
+	if err != nil {
+		return err
+	}
+
+	return c.writeFrame(addr, IPv6_PROTOCOL, b)
+}
+
+// read frames until one carries an ICMPv6 message of the type, the other frames are skipped
+// the frame info has the receive time of the frame
+func (c *Client) receiveICMPv6(typ uint8) (*IPv6Header, *EthernetHeader, FrameInfo, error) {
+	bp := c.getFrameBuf()
+	defer putFrameBuf(bp)
+	buf := *bp
+
+	for {
+		n, info, err := c.readFrame(buf)
+		if err != nil {
+			return nil, nil, FrameInfo{}, err
+		}
+		// a router advertisement with many options can be longer than the buffer, it is not dropped silently
+		if c.skipTruncated(n, info) {
+			continue
+		}
+
+		pkt := Decode(buf[:n])
+		if pkt.Err != nil {
+			c.counters.malformed.Add(1)
+			c.logger().Debug("skipping malformed packet", "err", pkt.Err)
+			continue
+		}
+
+		ip6, ok := pkt.Layer(LayerTypeIPv6).(*IPv6Header)
+		if !ok {
+			c.counters.rejected.Add(1)
+			continue
+		}
+		icmp, ok := pkt.Layer(LayerTypeICMPv6).(*ICMPv6Packet)
+		if !ok || icmp.Type != typ {
+			c.counters.rejected.Add(1)
+			continue
+		}
+		if isNDPType(typ) {
+			if err := checkNDP(ip6); err != nil {
+				c.counters.rejected.Add(1)
+				c.logger().Debug("skipping neighbor discovery message", "src", ip6.SourceIp, "err", err)
+				continue
+			}
+		}
+		c.counters.parsed.Add(1)
+
+		// the buffer goes back to the pool, so keep a copy
+		eth := pkt.Layer(LayerTypeEthernet).(*EthernetHeader)
+		return ip6.Clone(), eth.Clone(), info, nil
+	}
+}
+
+// a generic ICMPv6 message, the body is everything after the checksum
+// the body of the echo is the id, sequence and payload, the NDP messages can be unmarshalled from Contents
+type ICMPv6Packet struct {
+	Type     uint8  // 1 byte
+	Code     uint8  // 1 byte
+	Checksum uint16 // 2 bytes
+	Body     []byte // N bytes
+	// the whole message, header included
+	Contents []byte
+}
+
+// the body and contents point into b, same as DecodeFromBytes
+func (icmp *ICMPv6Packet) Unmarshal(b []byte) error {
+	return icmp.DecodeFromBytes(b)
+}
+
+// decode the message without copying, the body and contents point into b
+func (icmp *ICMPv6Packet) DecodeFromBytes(b []byte) error {
+	if len(b) < 4 {
+		return io.ErrUnexpectedEOF
+	}
+
+	icmp.Type = b[0]
+	icmp.Code = b[1]
+	icmp.Checksum = binary.BigEndian.Uint16(b[2:4])
+	icmp.Body = b[4:]
+	icmp.Contents = b
+
+	return nil
+}
@@ -0,0 +1,236 @@
+package netlibk
+
+import (
+	"encoding/binary"
+	"errors"
+	"iter"
+	"math/bits"
+	"net/netip"
+)
+
+// the range has more addresses than can be counted in uint64 (so it could never be scanned anyway)
+var ErrRangeTooLarge = errors.New("Error ip range too large to iterate")
+
+// options for the lazy address iterators
+type rangeConfig struct {
+	skipEdges bool
+	random    bool
+	seed      uint64
+	offset    uint64
+}
+
+type RangeOption func(*rangeConfig)
+
+// leave out the network and broadcast address of a prefix
+// for IPv6 only the first (subnet router anycast) address is left out because there is no broadcast
+// it does nothing for prefixes with no host part to spare (/31, /32, /127, /128) and for plain ranges
+func SkipNetworkBroadcast() RangeOption {
+	return func(rc *rangeConfig) {
+		rc.skipEdges = true
+	}
+}
+
+// go through the addresses in a pseudo random order, the same seed always gives the same order
+// the order is a permutation computed per index, so no slice of the whole range is ever made
+func RandomOrder(seed uint64) RangeOption {
+	return func(rc *rangeConfig) {
+		rc.random = true
+		rc.seed = seed
+	}
+}
+
+// skip the first n addresses of the iteration order, used to resume an interrupted scan
+// (with RandomOrder the same seed has to be given to resume in the same order)
+func FromOffset(n uint64) RangeOption {
+	return func(rc *rangeConfig) {
+		rc.offset = n
+	}
+}
+
+// lazily go through all the addresses from start to end (both included)
+func RangeAddrs(start, end netip.Addr, opts ...RangeOption) (iter.Seq[netip.Addr], error) {
+	if !start.IsValid() || !end.IsValid() {
+		return nil, ErrInvalidIP
+	}
+	start, end = start.Unmap().WithZone(""), end.Unmap().WithZone("")
+
+	if start.Is4() != end.Is4() {
+		return nil, &AddrError{Addr: start.String() + "-" + end.String(), Err: ErrMixedFamily}
+	}
+	if start.Compare(end) > 0 {
+		return nil, &AddrError{Addr: start.String() + "-" + end.String(), Err: ErrInvalidRange}
+	}
+
+	rc := new(rangeConfig)
+	for _, opt := range opts {
+		opt(rc)
+	}
+
+	return rangeSeq(start, end, rc)
+}
+
+// lazily go through all the addresses of the prefix
+func PrefixAddrs(p netip.Prefix, opts ...RangeOption) (iter.Seq[netip.Addr], error) {
+	if !p.IsValid() {
+		return nil, &AddrError{Addr: p.String(), Err: ErrInvalidCIDR}
+	}
+	p = p.Masked()
+
+	rc := new(rangeConfig)
+	for _, opt := range opts {
+		opt(rc)
+	}
+
+	start, end := p.Addr(), lastAddr(p)
+	hostBits := p.Addr().BitLen() - p.Bits()
+	if rc.skipEdges && hostBits > 1 {
+		start = start.Next()
+		if start.Is4() {
+			end = end.Prev()
+		}
+	}
+
+	return rangeSeq(start, end, rc)
+}
+
+// the last address of the (masked) prefix, so the one with all host bits set
+func lastAddr(p netip.Prefix) netip.Addr {
+	v := addrToU128(p.Addr())
+	hostBits := uint(p.Addr().BitLen() - p.Bits())
+
+	// set the lowest hostBits bits
+	switch {
+	case hostBits == 0:
+	case hostBits <= 64:
+		v.lo |= ^uint64(0) >> (64 - hostBits)
+	default:
+		v.lo = ^uint64(0)
+		v.hi |= ^uint64(0) >> (128 - hostBits)
+	}
+
+	return u128ToAddr(v, p.Addr().Is4())
+}
+
+func rangeSeq(start, end netip.Addr, rc *rangeConfig) (iter.Seq[netip.Addr], error) {
+	first := addrToU128(start)
+	diff := addrToU128(end).sub(first)
+	// the count is diff + 1, so the whole 2^64 (or more) can't be counted
+	if diff.hi != 0 || diff.lo == ^uint64(0) {
+		return nil, &AddrError{Addr: start.String() + "-" + end.String(), Err: ErrRangeTooLarge}
+	}
+	n := diff.lo + 1
+	is4 := start.Is4()
+
+	var perm *permutation
+	if rc.random {
+		perm = newPermutation(n, rc.seed)
+	}
+
+	return func(yield func(netip.Addr) bool) {
+		for i := rc.offset; i < n; i++ {
+			idx := i
+			if perm != nil {
+				idx = perm.at(i)
+			}
+			if !yield(u128ToAddr(first.add(idx), is4)) {
+				return
+			}
+		}
+	}, nil
+}
+
+// 128 bit unsigned int to do the address arithmetic for both families
+type u128 struct {
+	hi, lo uint64
+}
+
+func addrToU128(a netip.Addr) u128 {
+	b := a.As16()
+	return u128{
+		hi: binary.BigEndian.Uint64(b[:8]),
+		lo: binary.BigEndian.Uint64(b[8:]),
+	}
+}
+
+func u128ToAddr(v u128, is4 bool) netip.Addr {
+	if is4 {
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], uint32(v.lo))
+		return netip.AddrFrom4(b)
+	}
+
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], v.hi)
+	binary.BigEndian.PutUint64(b[8:], v.lo)
+	return netip.AddrFrom16(b)
+}
+
+func (v u128) add(n uint64) u128 {
+	lo, carry := bits.Add64(v.lo, n, 0)
+	return u128{hi: v.hi + carry, lo: lo}
+}
+
+func (v u128) sub(w u128) u128 {
+	lo, borrow := bits.Sub64(v.lo, w.lo, 0)
+	return u128{hi: v.hi - w.hi - borrow, lo: lo}
+}
+
+// a bijection on [0, n) made from a feistel network over the smallest power of 4 covering n
+// the values that land outside of n are encrypted again until they fall inside (cycle walking),
+// which takes less than 4 rounds on average because the domain is at most 4 times bigger than n
+type permutation struct {
+	n        uint64
+	halfBits uint
+	mask     uint64
+	keys     [4]uint64
+}
+
+func newPermutation(n, seed uint64) *permutation {
+	var b uint
+	if n > 1 {
+		b = uint(bits.Len64(n - 1))
+	}
+	// the two halves have to be the same size
+	half := (b + 1) / 2
+
+	p := &permutation{
+		n:        n,
+		halfBits: half,
+		mask:     (uint64(1) << half) - 1,
+	}
+	for i := range p.keys {
+		seed = splitmix64(seed)
+		p.keys[i] = seed
+	}
+
+	return p
+}
+
+// the i-th element of the permutation
+func (p *permutation) at(i uint64) uint64 {
+	if p.n <= 1 {
+		return i
+	}
+	for {
+		i = p.encrypt(i)
+		if i < p.n {
+			return i
+		}
+	}
+}
+
+func (p *permutation) encrypt(v uint64) uint64 {
+	l, r := v>>p.halfBits, v&p.mask
+	for _, k := range p.keys {
+		l, r = r, l^(splitmix64(r^k)&p.mask)
+	}
+	return l<<p.halfBits | r
+}
+
+// mixing function for the feistel rounds and the round keys
+func splitmix64(x uint64) uint64 {
+	x += 0x9e3779b97f4a7c15
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
@@ -0,0 +1,166 @@
+package netlibk
+
+import (
+	"errors"
+	"iter"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func TestPermutation(t *testing.T) {
+	sizes := []uint64{1, 2, 3, 4, 5, 7, 8, 15, 16, 17, 255, 256, 257, 1000, 1024, 4097}
+	for n := uint64(1); n <= 64; n++ {
+		sizes = append(sizes, n*3+1)
+	}
+
+	for _, n := range sizes {
+		for _, seed := range []uint64{0, 1, 0xdeadbeef} {
+			p := newPermutation(n, seed)
+			seen := make([]bool, n)
+			for i := range n {
+				v := p.at(i)
+				if v >= n {
+					t.Fatalf("n %d seed %d: at(%d) = %d out of range", n, seed, i, v)
+				}
+				if seen[v] {
+					t.Fatalf("n %d seed %d: at(%d) = %d twice", n, seed, i, v)
+				}
+				seen[v] = true
+			}
+		}
+	}
+}
+
+func collectAddrs(t *testing.T, seq iter.Seq[netip.Addr], err error) []netip.Addr {
+	t.Helper()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return slices.Collect(seq)
+}
+
+// every address of the range exactly once, in any order
+func checkCoverage(t *testing.T, got []netip.Addr, first, last netip.Addr) {
+	t.Helper()
+
+	sorted := slices.SortedFunc(slices.Values(got), netip.Addr.Compare)
+	if len(slices.Compact(slices.Clone(sorted))) != len(sorted) {
+		t.Fatalf("duplicate addresses in %v", got)
+	}
+	want := []netip.Addr{}
+	for a := first; a.IsValid() && a.Compare(last) <= 0; a = a.Next() {
+		want = append(want, a)
+	}
+	if !slices.Equal(sorted, want) {
+		t.Fatalf("got %v, want %v", sorted, want)
+	}
+}
+
+func TestPrefixAddrs(t *testing.T) {
+	tests := []struct {
+		prefix      string
+		skip        bool
+		first, last string
+	}{
+		{"192.0.2.0/24", false, "192.0.2.0", "192.0.2.255"},
+		{"192.0.2.0/24", true, "192.0.2.1", "192.0.2.254"},
+		{"192.0.2.77/24", true, "192.0.2.1", "192.0.2.254"},
+		{"192.0.2.8/30", true, "192.0.2.9", "192.0.2.10"},
+		{"192.0.2.8/31", true, "192.0.2.8", "192.0.2.9"},
+		{"192.0.2.8/32", true, "192.0.2.8", "192.0.2.8"},
+		{"0.0.0.0/30", false, "0.0.0.0", "0.0.0.3"},
+		{"255.255.255.252/30", false, "255.255.255.252", "255.255.255.255"},
+		{"255.255.255.252/30", true, "255.255.255.253", "255.255.255.254"},
+		{"2001:db8::/120", false, "2001:db8::", "2001:db8::ff"},
+		{"2001:db8::/120", true, "2001:db8::1", "2001:db8::ff"},
+		{"::/126", false, "::", "::3"},
+		{"ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffc/126", false, "ffff:ffff:ffff:ffff:ffff:ffff:ffff:fffc", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+	}
+
+	for _, tt := range tests {
+		p := netip.MustParsePrefix(tt.prefix)
+		first, last := netip.MustParseAddr(tt.first), netip.MustParseAddr(tt.last)
+
+		var opts []RangeOption
+		if tt.skip {
+			opts = append(opts, SkipNetworkBroadcast())
+		}
+
+		seq, err := PrefixAddrs(p, opts...)
+		got := collectAddrs(t, seq, err)
+		if got[0] != first || got[len(got)-1] != last {
+			t.Fatalf("%s: in order from %v to %v, want %v to %v", tt.prefix, got[0], got[len(got)-1], first, last)
+		}
+		checkCoverage(t, got, first, last)
+
+		seq, err = PrefixAddrs(p, append(opts, RandomOrder(42))...)
+		checkCoverage(t, collectAddrs(t, seq, err), first, last)
+	}
+}
+
+func TestRangeAddrs(t *testing.T) {
+	tests := []struct {
+		start, end string
+		err        error
+	}{
+		{"10.0.0.250", "10.0.1.5", nil},
+		{"10.0.0.1", "10.0.0.1", nil},
+		{"0.0.0.0", "0.0.0.9", nil},
+		{"255.255.255.250", "255.255.255.255", nil},
+		{"2001:db8::fffe", "2001:db8::1:3", nil},
+		{"::ffff:10.0.0.1", "10.0.0.3", nil},
+		{"10.0.0.5", "10.0.0.1", ErrInvalidRange},
+		{"10.0.0.1", "2001:db8::1", ErrMixedFamily},
+		{"::", "::1:0:0:0:0", ErrRangeTooLarge},
+	}
+
+	for _, tt := range tests {
+		start, end := netip.MustParseAddr(tt.start), netip.MustParseAddr(tt.end)
+
+		seq, err := RangeAddrs(start, end)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("%s-%s: error %v, want %v", tt.start, tt.end, err, tt.err)
+			}
+			continue
+		}
+		got := collectAddrs(t, seq, err)
+		checkCoverage(t, got, start.Unmap(), end.Unmap())
+
+		for _, seed := range []uint64{0, 7} {
+			seq, err := RangeAddrs(start, end, RandomOrder(seed))
+			random := collectAddrs(t, seq, err)
+			checkCoverage(t, random, start.Unmap(), end.Unmap())
+
+			// resuming in the same order gives the rest of it
+			seq, err = RangeAddrs(start, end, RandomOrder(seed), FromOffset(uint64(len(random)/2)))
+			if rest := collectAddrs(t, seq, err); !slices.Equal(rest, random[len(random)/2:]) {
+				t.Fatalf("%s-%s: resumed at %d got %v, want %v", tt.start, tt.end, len(random)/2, rest, random[len(random)/2:])
+			}
+		}
+	}
+}
+
+// the whole address space is too big to walk in a test, so only its ends are checked
+func TestPrefixAddrsWhole(t *testing.T) {
+	seq, err := PrefixAddrs(netip.MustParsePrefix("0.0.0.0/0"), FromOffset(1<<32-3))
+	got := collectAddrs(t, seq, err)
+	checkCoverage(t, got, netip.MustParseAddr("255.255.255.253"), netip.MustParseAddr("255.255.255.255"))
+
+	seq, err = PrefixAddrs(netip.MustParsePrefix("0.0.0.0/0"), RandomOrder(1), FromOffset(1<<32-1000))
+	got = collectAddrs(t, seq, err)
+	if len(got) != 1000 || len(slices.Compact(slices.SortedFunc(slices.Values(got), netip.Addr.Compare))) != 1000 {
+		t.Fatalf("the last 1000 random addresses of 0.0.0.0/0 are not 1000 different ones")
+	}
+
+	seq, err = PrefixAddrs(netip.MustParsePrefix("::/65"), FromOffset(1<<63-2))
+	got = collectAddrs(t, seq, err)
+	checkCoverage(t, got, netip.MustParseAddr("::7fff:ffff:ffff:fffe"), netip.MustParseAddr("::7fff:ffff:ffff:ffff"))
+
+	for _, p := range []string{"::/0", "::/64", "2001:db8::/63"} {
+		if _, err := PrefixAddrs(netip.MustParsePrefix(p)); !errors.Is(err, ErrRangeTooLarge) {
+			t.Fatalf("%s: error %v, want %v", p, err, ErrRangeTooLarge)
+		}
+	}
+}
@@ -1,37 +1,131 @@
 package netlibk
 
 import (
-	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
 	"math/rand/v2"
 	"net"
+	"net/netip"
 )
 
+// ip protocol number of ICMP
+const ICMP_PROTOCOL uint8 = 1
+
+// the packet is not a valid IPv4 packet
+var ErrInvalidIPv4Packet = errors.New("Invalid IPv4 packet")
+
 func BuildIPv4Header(sourceIp, destIp net.IP, protocol uint16, payload []byte) ([]byte, error) {
+	src, ok := netip.AddrFromSlice(sourceIp)
+	if !ok {
+		return nil, ErrInvalidIP
+	}
+	dst, ok := netip.AddrFromSlice(destIp)
+	if !ok {
+		return nil, ErrInvalidIP
+	}
+	return BuildIPv4HeaderAddr(src.Unmap(), dst.Unmap(), protocol, payload)
+}
+
+// same as BuildIPv4Header but with netip addresses
+func BuildIPv4HeaderAddr(sourceIp, destIp netip.Addr, protocol uint16, payload []byte) ([]byte, error) {
+	if !sourceIp.Is4() || !destIp.Is4() {
+		return nil, ErrInvalidIP
+	}
+
 	header := IPv4Header{
-		Version:        0x45, // Version 4 and IHL 5 (20 bytes)
-		Service:        0,    // Default
-		TotalLen:       htons(uint16(20 + len(payload))),
-		Id:             htons(uint16(rand.IntN(65535))), // random int ID
+		Version:        4,
+		HeaderLen:      5, // 20 bytes, no options
+		Service:        0, // Default
+		TotalLen:       uint16(20 + len(payload)),
+		Id:             uint16(rand.IntN(65535)), // random int ID
 		FragmentOffset: 0,
 		TTL:            64, // Default
 		Protocol:       uint8(protocol),
-		// calculate checksum later from buffer
+		SourceIp:       sourceIp.As4(),
+		DestIp:         destIp.As4(),
+	}
+
+	b := make([]byte, 20)
+	header.marshalTo(b)
+	binary.BigEndian.PutUint16(b[10:12], checksum(b))
+
+	return b, nil
+}
+
+// write the fixed 20 bytes of the header into b, the checksum as it is in the header
+func (h *IPv4Header) marshalTo(b []byte) {
+	// 4 bits version, 4 bits IHL
+	// 1 byte service
+	// 2 bytes total length
+	// 2 bytes id
+	// 3 bits flags, 13 bits fragment offset
+	// 1 byte ttl
+	// 1 byte protocol
+	// 2 bytes checksum
+	// 4 bytes source address
+	// 4 bytes destination address
+	b[0] = h.Version<<4 | h.HeaderLen&0x0f
+	b[1] = h.Service
+	binary.BigEndian.PutUint16(b[2:4], h.TotalLen)
+	binary.BigEndian.PutUint16(b[4:6], h.Id)
+	binary.BigEndian.PutUint16(b[6:8], h.Flags<<13|h.FragmentOffset&0x1fff)
+	b[8] = h.TTL
+	b[9] = h.Protocol
+	binary.BigEndian.PutUint16(b[10:12], h.Checksum)
+	copy(b[12:16], h.SourceIp[:])
+	copy(b[16:20], h.DestIp[:])
+}
+
+// the source ip of the header as netip address
+func (h *IPv4Header) SourceAddr() netip.Addr {
+	return netip.AddrFrom4(h.SourceIp)
+}
+
+// the destination ip of the header as netip address
+func (h *IPv4Header) DestAddr() netip.Addr {
+	return netip.AddrFrom4(h.DestIp)
+}
+
+// unmarshal the fixed part of the IPv4 header from the packet, the options are skipped
+// the payload starts after HeaderLen*4 bytes and ends at TotalLen
+func (h *IPv4Header) Unmarshal(b []byte) error {
+	if len(b) < 20 {
+		return io.ErrUnexpectedEOF
+	}
+
+	h.Version = b[0] >> 4
+	if h.Version != 4 {
+		return ErrInvalidIPv4Packet
 	}
+	h.HeaderLen = b[0] & 0x0f
+	h.Service = b[1]
+	h.TotalLen = binary.BigEndian.Uint16(b[2:4])
+	h.Id = binary.BigEndian.Uint16(b[4:6])
 
-	copy(header.SourceIp[:], sourceIp.To4())
-	copy(header.DestIp[:], destIp.To4())
+	// 3 bits of flags and 13 bits of fragment offset
+	fl := binary.BigEndian.Uint16(b[6:8])
+	h.Flags = fl >> 13
+	h.FragmentOffset = fl & 0x1fff
 
-	// make a byte slice for the header
-	// buf := make([]byte, header.TotalLen)
-	buf := new(bytes.Buffer)
-	binary.Write(buf, binary.BigEndian, header)
+	h.TTL = b[8]
+	h.Protocol = b[9]
+	h.Checksum = binary.BigEndian.Uint16(b[10:12])
+	copy(h.SourceIp[:], b[12:16])
+	copy(h.DestIp[:], b[16:20])
 
-	header.Checksum = htons(checksum(buf.Bytes()))
+	hlen := int(h.HeaderLen) * 4
+	if hlen < 20 || int(h.TotalLen) < hlen {
+		return ErrInvalidIPv4Packet
+	}
+	if len(b) < int(h.TotalLen) {
+		return io.ErrUnexpectedEOF
+	}
 
-	// remake it with the checksum also
-	buf.Reset()
-	binary.Write(buf, binary.BigEndian, header)
+	return nil
+}
 
-	return buf.Bytes(), nil
+// the payload of the packet the header was unmarshalled from
+func (h *IPv4Header) payload(b []byte) []byte {
+	return b[int(h.HeaderLen)*4 : h.TotalLen]
 }
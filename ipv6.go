@@ -0,0 +1,214 @@
+package netlibk
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/netip"
+)
+
+const (
+	ipv6HeaderLen = 40
+
+	// next header value of ICMPv6
+	ICMPv6_PROTOCOL uint8 = 58
+)
+
+// IPv6 extension header types (next header values)
+const (
+	IPv6HopByHop     uint8 = 0
+	IPv6Routing      uint8 = 43
+	IPv6Fragment     uint8 = 44
+	IPv6AuthHeader   uint8 = 51
+	IPv6DestOptions  uint8 = 60
+	IPv6NoNextHeader uint8 = 59
+)
+
+// the packet is not an IPv6 packet
+var ErrInvalidIPv6Packet = errors.New("Invalid IPv6 packet")
+
+type IPv6Header struct {
+	Version      uint8  // always 6
+	TrafficClass uint8  // DSCP/ECN
+	FlowLabel    uint32 // 20 bits
+	PayloadLen   uint16 // length of everything after the fixed header, so extension headers + payload
+	NextHeader   uint8  // type of the first header after the fixed one
+	HopLimit     uint8
+	SourceIp     netip.Addr
+	DestIp       netip.Addr
+
+	// the extension headers between the fixed header and the payload, in order
+	ExtensionHeaders []IPv6ExtensionHeader
+	// the upper layer protocol after the extension headers, same as NextHeader when there are none
+	Protocol uint8
+	// the upper layer payload
+	Payload []byte
+}
+
+// one extension header, the data is the whole header including its next header and length bytes
+type IPv6ExtensionHeader struct {
+	Type uint8
+	Data []byte
+}
+
+// build the IPv6 header for the payload of the protocol without extension headers
+func BuildIPv6Header(sourceIp, destIp netip.Addr, protocol uint8, hopLimit uint8, payload []byte) (*IPv6Header, error) {
+	if !sourceIp.Is6() || !destIp.Is6() {
+		return nil, ErrInvalidIP
+	}
+
+	return &IPv6Header{
+		Version:    6,
+		PayloadLen: uint16(len(payload)),
+		NextHeader: protocol,
+		HopLimit:   hopLimit,
+		SourceIp:   sourceIp,
+		DestIp:     destIp,
+		Protocol:   protocol,
+		Payload:    payload,
+	}, nil
+}
+
+// malloc a byte slice with the header, the extension headers and the payload
+// the payload length is computed from the extension headers and the payload
+func (h *IPv6Header) Marshal() ([]byte, error) {
+	if !h.SourceIp.Is6() || !h.DestIp.Is6() {
+		return nil, ErrInvalidIP
+	}
+
+	extLen := 0
+	for _, ext := range h.ExtensionHeaders {
+		extLen += len(ext.Data)
+	}
+	h.PayloadLen = uint16(extLen + len(h.Payload))
+
+	// 4 bytes version, traffic class and flow label
+	// 2 bytes payload length
+	// 1 byte next header
+	// 1 byte hop limit
+	// 16 bytes source address
+	// 16 bytes destination address
+	b := make([]byte, ipv6HeaderLen+int(h.PayloadLen))
+
+	binary.BigEndian.PutUint32(b[0:4], 6<<28|uint32(h.TrafficClass)<<20|h.FlowLabel&0xfffff)
+	binary.BigEndian.PutUint16(b[4:6], h.PayloadLen)
+	b[6] = h.NextHeader
+	b[7] = h.HopLimit
+
+	s, d := h.SourceIp.As16(), h.DestIp.As16()
+	copy(b[8:24], s[:])
+	copy(b[24:40], d[:])
+
+	n := ipv6HeaderLen
+	for _, ext := range h.ExtensionHeaders {
+		n += copy(b[n:], ext.Data)
+	}
+	copy(b[n:], h.Payload)
+
+	return b, nil
+}
+
+// unmarshal the packet and walk the extension headers to get to the upper layer protocol and payload
+// the extension headers and the payload point into b
+func (h *IPv6Header) Unmarshal(b []byte) error {
+	if len(b) < ipv6HeaderLen {
+		return io.ErrUnexpectedEOF
+	}
+
+	first := binary.BigEndian.Uint32(b[0:4])
+	h.Version = uint8(first >> 28)
+	if h.Version != 6 {
+		return ErrInvalidIPv6Packet
+	}
+	h.TrafficClass = uint8(first >> 20)
+	h.FlowLabel = first & 0xfffff
+	h.PayloadLen = binary.BigEndian.Uint16(b[4:6])
+	h.NextHeader = b[6]
+	h.HopLimit = b[7]
+	h.SourceIp = netip.AddrFrom16([16]byte(b[8:24]))
+	h.DestIp = netip.AddrFrom16([16]byte(b[24:40]))
+
+	// the frame can be padded, so only the payload length counts
+	end := ipv6HeaderLen + int(h.PayloadLen)
+	if len(b) < end {
+		return io.ErrUnexpectedEOF
+	}
+	rest := b[ipv6HeaderLen:end]
+
+	h.ExtensionHeaders = h.ExtensionHeaders[:0]
+	next := h.NextHeader
+	for isIPv6ExtensionHeader(next) {
+		n, err := ipv6ExtensionHeaderLen(next, rest)
+		if err != nil {
+			return err
+		}
+
+		h.ExtensionHeaders = append(h.ExtensionHeaders, IPv6ExtensionHeader{Type: next, Data: rest[:n]})
+		next = rest[0]
+		rest = rest[n:]
+	}
+
+	h.Protocol = next
+	h.Payload = rest
+
+	return nil
+}
+
+// a deep copy of the header that does not point into the decoded buffer
+func (h *IPv6Header) Clone() *IPv6Header {
+	c := *h
+	c.ExtensionHeaders = make([]IPv6ExtensionHeader, len(h.ExtensionHeaders))
+	for i, e := range h.ExtensionHeaders {
+		c.ExtensionHeaders[i] = IPv6ExtensionHeader{Type: e.Type, Data: append([]byte(nil), e.Data...)}
+	}
+	c.Payload = append([]byte(nil), h.Payload...)
+	return &c
+}
+
+func isIPv6ExtensionHeader(t uint8) bool {
+	switch t {
+	case IPv6HopByHop, IPv6Routing, IPv6Fragment, IPv6AuthHeader, IPv6DestOptions:
+		return true
+	}
+	return false
+}
+
+// the length of the extension header in bytes from its length field
+func ipv6ExtensionHeaderLen(t uint8, b []byte) (int, error) {
+	if len(b) < 2 {
+		return 0, io.ErrUnexpectedEOF
+	}
+
+	var n int
+	switch t {
+	case IPv6Fragment:
+		// fixed 8 bytes, the second byte is reserved
+		n = 8
+	case IPv6AuthHeader:
+		// counted in 4 byte units, minus 2
+		n = (int(b[1]) + 2) * 4
+	default:
+		// counted in 8 byte units, not including the first 8 bytes
+		n = (int(b[1]) + 1) * 8
+	}
+
+	if len(b) < n {
+		return 0, io.ErrUnexpectedEOF
+	}
+	return n, nil
+}
+
+// the ICMPv6 checksum covers the pseudo header (addresses, length and next header) and the whole message
+// the checksum field of the message has to be zero when computing it
+func ICMPv6Checksum(src, dst netip.Addr, msg []byte) uint16 {
+	b := make([]byte, 40+len(msg))
+
+	s, d := src.As16(), dst.As16()
+	copy(b[0:16], s[:])
+	copy(b[16:32], d[:])
+	binary.BigEndian.PutUint32(b[32:36], uint32(len(msg)))
+	b[39] = ICMPv6_PROTOCOL
+	copy(b[40:], msg)
+
+	return checksum(b)
+}
@@ -0,0 +1,349 @@
+package netlibk
+
+import (
+	"fmt"
+	"sync"
+)
+
+// the kind of a decoded layer
+type LayerType int
+
+const (
+	LayerTypeRaw LayerType = iota
+	LayerTypeEthernet
+	LayerTypeVLAN
+	LayerTypeARP
+	LayerTypeIPv4
+	LayerTypeIPv6
+	LayerTypeICMP
+	LayerTypeICMPv6
+	LayerTypeUDP
+	LayerTypeTCP
+)
+
+var layerTypeNames = map[LayerType]string{
+	LayerTypeRaw:      "Raw",
+	LayerTypeEthernet: "Ethernet",
+	LayerTypeVLAN:     "VLAN",
+	LayerTypeARP:      "ARP",
+	LayerTypeIPv4:     "IPv4",
+	LayerTypeIPv6:     "IPv6",
+	LayerTypeICMP:     "ICMP",
+	LayerTypeICMPv6:   "ICMPv6",
+	LayerTypeUDP:      "UDP",
+	LayerTypeTCP:      "TCP",
+}
+
+func (t LayerType) String() string {
+	if name, ok := layerTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("LayerType(%d)", int(t))
+}
+
+// one decoded protocol header of a packet
+type Layer interface {
+	LayerType() LayerType
+}
+
+// a layer whose payload is of the ether type (ethernet and vlan)
+type EtherTypeCarrier interface {
+	Layer
+	NextEtherType() EtherType
+}
+
+// a layer whose payload is of the ip protocol (IPv4 and IPv6)
+type IPProtocolCarrier interface {
+	Layer
+	NextIPProtocol() uint8
+}
+
+// decode the layer from the start of b, returns the layer and the bytes after it (its payload)
+type DecodeFunc func(b []byte) (Layer, []byte, error)
+
+// the bytes no decoder was found for, or that could not be decoded
+type RawLayer struct {
+	Data []byte
+}
+
+func (*RawLayer) LayerType() LayerType { return LayerTypeRaw }
+
+// the decoders for the ether types and the ip protocols, new protocols are plugged in with the Register functions
+var (
+	decodersMu         sync.RWMutex
+	etherTypeDecoders  = map[EtherType]DecodeFunc{}
+	ipProtocolDecoders = map[uint8]DecodeFunc{}
+)
+
+func init() {
+	RegisterEtherType(ARP_PROTOCOL, decodeARP)
+	RegisterEtherType(IPv4_PROTOCOL, decodeIPv4)
+	RegisterEtherType(IPv6_PROTOCOL, decodeIPv6)
+
+	RegisterIPProtocol(ICMP_PROTOCOL, decodeICMP)
+	RegisterIPProtocol(ICMPv6_PROTOCOL, decodeICMPv6)
+	RegisterIPProtocol(UDP_PROTOCOL, decodeUDP)
+	RegisterIPProtocol(TCP_PROTOCOL, decodeTCP)
+}
+
+// set the decoder for the payload of the ether type, it replaces the one already registered
+func RegisterEtherType(t EtherType, fn DecodeFunc) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	etherTypeDecoders[t] = fn
+}
+
+// set the decoder for the payload of the ip protocol, it replaces the one already registered
+func RegisterIPProtocol(p uint8, fn DecodeFunc) {
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	ipProtocolDecoders[p] = fn
+}
+
+// pick the decoder for whatever comes after the layer, nil when there is none
+func nextDecoder(l Layer) DecodeFunc {
+	decodersMu.RLock()
+	defer decodersMu.RUnlock()
+
+	switch c := l.(type) {
+	case EtherTypeCarrier:
+		return etherTypeDecoders[c.NextEtherType()]
+	case IPProtocolCarrier:
+		return ipProtocolDecoders[c.NextIPProtocol()]
+	}
+	return nil
+}
+
+// all the layers decoded from a frame
+type Packet struct {
+	Layers []Layer
+	// why the decoding stopped before the end, nil when everything was decoded or unknown
+	Err error
+}
+
+// the first layer of the type, nil if the packet does not have it
+func (p Packet) Layer(t LayerType) Layer {
+	for _, l := range p.Layers {
+		if l.LayerType() == t {
+			return l
+		}
+	}
+	return nil
+}
+
+// decode the ethernet frame into all the layers that are recognized, the rest ends up in a RawLayer
+// the layers are decoded without copying, so they point into b and b must not be reused while the packet is used
+// (Clone the layers to keep them)
+func Decode(b []byte) Packet {
+	var p Packet
+
+	eth := new(EthernetHeader)
+	if err := eth.DecodeFromBytes(b); err != nil {
+		p.Layers = append(p.Layers, &RawLayer{Data: b})
+		p.Err = err
+		return p
+	}
+
+	p.Layers = append(p.Layers, eth)
+	for i := range eth.VLANs {
+		p.Layers = append(p.Layers, &eth.VLANs[i])
+	}
+
+	var l Layer = eth
+	rest := eth.Payload
+	for len(rest) > 0 {
+		fn := nextDecoder(l)
+		if fn == nil {
+			p.Layers = append(p.Layers, &RawLayer{Data: rest})
+			break
+		}
+
+		next, payload, err := fn(rest)
+		if err != nil {
+			p.Layers = append(p.Layers, &RawLayer{Data: rest})
+			p.Err = err
+			break
+		}
+
+		p.Layers = append(p.Layers, next)
+		l, rest = next, payload
+	}
+
+	return p
+}
+
+func (*EthernetHeader) LayerType() LayerType        { return LayerTypeEthernet }
+func (et *EthernetHeader) NextEtherType() EtherType { return et.EtherType }
+
+func (*VLANTag) LayerType() LayerType { return LayerTypeVLAN }
+
+func (*ARPPacket) LayerType() LayerType { return LayerTypeARP }
+
+func (*IPv4Header) LayerType() LayerType    { return LayerTypeIPv4 }
+func (h *IPv4Header) NextIPProtocol() uint8 { return h.Protocol }
+
+func (*IPv6Header) LayerType() LayerType    { return LayerTypeIPv6 }
+func (h *IPv6Header) NextIPProtocol() uint8 { return h.Protocol }
+
+func (*ICMPPacket) LayerType() LayerType   { return LayerTypeICMP }
+func (*ICMPv6Packet) LayerType() LayerType { return LayerTypeICMPv6 }
+func (*UDPHeader) LayerType() LayerType    { return LayerTypeUDP }
+func (*TCPHeader) LayerType() LayerType    { return LayerTypeTCP }
+
+func decodeARP(b []byte) (Layer, []byte, error)    { return decodeLayer(new(ARPPacket), b) }
+func decodeIPv4(b []byte) (Layer, []byte, error)   { return decodeLayer(new(IPv4Header), b) }
+func decodeIPv6(b []byte) (Layer, []byte, error)   { return decodeLayer(new(IPv6Header), b) }
+func decodeICMP(b []byte) (Layer, []byte, error)   { return decodeLayer(new(ICMPPacket), b) }
+func decodeICMPv6(b []byte) (Layer, []byte, error) { return decodeLayer(new(ICMPv6Packet), b) }
+func decodeUDP(b []byte) (Layer, []byte, error)    { return decodeLayer(new(UDPHeader), b) }
+func decodeTCP(b []byte) (Layer, []byte, error)    { return decodeLayer(new(TCPHeader), b) }
+
+func decodeLayer(l DecodingLayer, b []byte) (Layer, []byte, error) {
+	payload, err := l.DecodeLayer(b)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l, payload, nil
+}
+
+// a layer that decodes itself in place, so the same value can be reused for every frame
+type DecodingLayer interface {
+	Layer
+	// decode the layer from the start of b without copying, returns the bytes after it (its payload)
+	DecodeLayer(b []byte) ([]byte, error)
+	// the type of the layer in the payload, LayerTypeRaw when it is not known
+	NextLayerType() LayerType
+}
+
+// the layers of the ether types and ip protocols the package decodes itself
+var (
+	etherTypeLayers = map[EtherType]LayerType{
+		ARP_PROTOCOL:  LayerTypeARP,
+		IPv4_PROTOCOL: LayerTypeIPv4,
+		IPv6_PROTOCOL: LayerTypeIPv6,
+	}
+	ipProtocolLayers = map[uint8]LayerType{
+		ICMP_PROTOCOL:   LayerTypeICMP,
+		ICMPv6_PROTOCOL: LayerTypeICMPv6,
+		UDP_PROTOCOL:    LayerTypeUDP,
+		TCP_PROTOCOL:    LayerTypeTCP,
+	}
+)
+
+func etherTypeLayer(t EtherType) LayerType {
+	if l, ok := etherTypeLayers[t]; ok {
+		return l
+	}
+	return LayerTypeRaw
+}
+
+func ipProtocolLayer(p uint8) LayerType {
+	if l, ok := ipProtocolLayers[p]; ok {
+		return l
+	}
+	return LayerTypeRaw
+}
+
+func (et *EthernetHeader) DecodeLayer(b []byte) ([]byte, error) {
+	if err := et.DecodeFromBytes(b); err != nil {
+		return nil, err
+	}
+	return et.Payload, nil
+}
+func (et *EthernetHeader) NextLayerType() LayerType { return etherTypeLayer(et.EtherType) }
+
+// the ethernet frame can be padded after the arp packet, so nothing comes after it
+func (p *ARPPacket) DecodeLayer(b []byte) ([]byte, error) { return nil, p.DecodeFromBytes(b) }
+func (*ARPPacket) NextLayerType() LayerType               { return LayerTypeRaw }
+
+func (h *IPv4Header) DecodeLayer(b []byte) ([]byte, error) {
+	if err := h.Unmarshal(b); err != nil {
+		return nil, err
+	}
+	return h.payload(b), nil
+}
+func (h *IPv4Header) NextLayerType() LayerType { return ipProtocolLayer(h.Protocol) }
+
+// the extension headers and the payload point into b
+func (h *IPv6Header) DecodeLayer(b []byte) ([]byte, error) {
+	if err := h.Unmarshal(b); err != nil {
+		return nil, err
+	}
+	return h.Payload, nil
+}
+func (h *IPv6Header) NextLayerType() LayerType { return ipProtocolLayer(h.Protocol) }
+
+func (icmp *ICMPPacket) DecodeLayer(b []byte) ([]byte, error) { return nil, icmp.DecodeFromBytes(b) }
+func (*ICMPPacket) NextLayerType() LayerType                  { return LayerTypeRaw }
+
+func (icmp *ICMPv6Packet) DecodeLayer(b []byte) ([]byte, error) { return nil, icmp.DecodeFromBytes(b) }
+func (*ICMPv6Packet) NextLayerType() LayerType                  { return LayerTypeRaw }
+
+func (u *UDPHeader) DecodeLayer(b []byte) ([]byte, error) {
+	if err := u.DecodeFromBytes(b); err != nil {
+		return nil, err
+	}
+	return b[8:u.Length], nil
+}
+func (*UDPHeader) NextLayerType() LayerType { return LayerTypeRaw }
+
+func (t *TCPHeader) DecodeLayer(b []byte) ([]byte, error) {
+	if err := t.DecodeFromBytes(b); err != nil {
+		return nil, err
+	}
+	return b[int(t.DataOffset)*4:], nil
+}
+func (*TCPHeader) NextLayerType() LayerType { return LayerTypeRaw }
+
+// decodes the frames into a fixed set of layers that are reused for every frame, so decoding does not allocate
+// it is the fast path next to Decode for code that reads a lot of frames and knows which layers it wants,
+// the layers point into the decoded buffer and are overwritten by the next DecodeLayers
+// it is not safe for concurrent use, make one per goroutine
+type DecodingLayerParser struct {
+	first  LayerType
+	layers map[LayerType]DecodingLayer
+}
+
+// make a parser that starts with the first layer type (usually LayerTypeEthernet) and decodes into the layers,
+// there is one layer of every type, a second one of the same type replaces the first one
+func NewDecodingLayerParser(first LayerType, layers ...DecodingLayer) *DecodingLayerParser {
+	p := &DecodingLayerParser{
+		first:  first,
+		layers: make(map[LayerType]DecodingLayer, len(layers)),
+	}
+	for _, l := range layers {
+		p.layers[l.LayerType()] = l
+	}
+	return p
+}
+
+// decode the frame into the layers of the parser, the types of the decoded ones are put into decoded in order
+// (the VLAN tags are in the ethernet layer, they show up as LayerTypeVLAN after it)
+// it stops without an error at the end or at a layer the parser has no DecodingLayer for,
+// the error is the one of the layer that could not be decoded
+func (p *DecodingLayerParser) DecodeLayers(b []byte, decoded *[]LayerType) error {
+	*decoded = (*decoded)[:0]
+
+	t, rest := p.first, b
+	for len(rest) > 0 {
+		l, ok := p.layers[t]
+		if !ok {
+			return nil
+		}
+
+		payload, err := l.DecodeLayer(rest)
+		if err != nil {
+			return err
+		}
+
+		*decoded = append(*decoded, t)
+		if eth, ok := l.(*EthernetHeader); ok {
+			for range eth.VLANs {
+				*decoded = append(*decoded, LayerTypeVLAN)
+			}
+		}
+		t, rest = l.NextLayerType(), payload
+	}
+
+	return nil
+}
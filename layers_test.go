@@ -0,0 +1,197 @@
+package netlibk
+
+import (
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+func icmpTestFrame(tb testing.TB) []byte {
+	return serializeTestFrame(tb,
+		&EthernetHeader{DestAddr: testDstMAC, SourceAddr: testSrcMAC, EtherType: IPv4_PROTOCOL},
+		&IPv4Header{Version: 4, TTL: 64, Protocol: ICMP_PROTOCOL, SourceIp: [4]byte{192, 0, 2, 2}, DestIp: [4]byte{192, 0, 2, 1}},
+		&ICMPPacket{Type: 8, Id: 0x1234, Seq: 7, Payload: []byte("ping payload")},
+	)
+}
+
+func udpTestFrame(tb testing.TB) []byte {
+	return serializeTestFrame(tb,
+		&EthernetHeader{DestAddr: testDstMAC, SourceAddr: testSrcMAC, VLANs: []VLANTag{{TPID: VLAN_PROTOCOL, VID: 10}}, EtherType: IPv6_PROTOCOL},
+		&IPv6Header{Version: 6, HopLimit: 64, NextHeader: UDP_PROTOCOL, Protocol: UDP_PROTOCOL,
+			SourceIp: netip.MustParseAddr("fd00::2"), DestIp: netip.MustParseAddr("fd00::1")},
+		&UDPHeader{SourcePort: 5353, DestPort: 53},
+		&RawLayer{Data: []byte("udp payload")},
+	)
+}
+
+func arpTestFrame(tb testing.TB) []byte {
+	p, err := BuildARPPacketAddr(OperationRequest, netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("192.0.2.1"), testSrcMAC, EthernetBroadcast)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return serializeTestFrame(tb, &EthernetHeader{DestAddr: EthernetBroadcast, SourceAddr: testSrcMAC, EtherType: ARP_PROTOCOL}, p)
+}
+
+// the layers the parser decodes into, one of every kind
+type testParser struct {
+	eth  EthernetHeader
+	arp  ARPPacket
+	ip4  IPv4Header
+	ip6  IPv6Header
+	icmp ICMPPacket
+	udp  UDPHeader
+	tcp  TCPHeader
+
+	parser  *DecodingLayerParser
+	decoded []LayerType
+}
+
+func newTestParser() *testParser {
+	p := &testParser{decoded: make([]LayerType, 0, 8)}
+	p.parser = NewDecodingLayerParser(LayerTypeEthernet, &p.eth, &p.arp, &p.ip4, &p.ip6, &p.icmp, &p.udp, &p.tcp)
+	return p
+}
+
+func TestDecodingLayerParser(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		want  []LayerType
+	}{
+		{"icmp", icmpTestFrame(t), []LayerType{LayerTypeEthernet, LayerTypeIPv4, LayerTypeICMP}},
+		{"udp", udpTestFrame(t), []LayerType{LayerTypeEthernet, LayerTypeVLAN, LayerTypeIPv6, LayerTypeUDP}},
+		{"arp", arpTestFrame(t), []LayerType{LayerTypeEthernet, LayerTypeARP}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestParser()
+			if err := p.parser.DecodeLayers(tt.frame, &p.decoded); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(p.decoded, tt.want) {
+				t.Fatalf("decoded %v, want %v", p.decoded, tt.want)
+			}
+
+			// the same fields as the allocating Decode
+			pkt := Decode(tt.frame)
+			if pkt.Err != nil {
+				t.Fatal(pkt.Err)
+			}
+			for _, typ := range p.decoded {
+				if typ == LayerTypeVLAN {
+					continue
+				}
+				if got, want := p.layer(typ), pkt.Layer(typ); !layersEqual(got, want) {
+					t.Errorf("%v layer: got %+v, want %+v", typ, got, want)
+				}
+			}
+		})
+	}
+}
+
+func (p *testParser) layer(t LayerType) Layer {
+	switch t {
+	case LayerTypeEthernet:
+		return &p.eth
+	case LayerTypeARP:
+		return &p.arp
+	case LayerTypeIPv4:
+		return &p.ip4
+	case LayerTypeIPv6:
+		return &p.ip6
+	case LayerTypeICMP:
+		return &p.icmp
+	case LayerTypeUDP:
+		return &p.udp
+	case LayerTypeTCP:
+		return &p.tcp
+	}
+	return nil
+}
+
+func layersEqual(a, b Layer) bool {
+	switch a := a.(type) {
+	case *EthernetHeader:
+		b := b.(*EthernetHeader)
+		return a.EtherType == b.EtherType && slices.Equal(a.VLANs, b.VLANs) &&
+			slices.Equal(a.Payload, b.Payload) && slices.Equal(a.SourceAddr, b.SourceAddr)
+	case *ARPPacket:
+		b := b.(*ARPPacket)
+		return a.Operation == b.Operation && a.SenderIp.Equal(b.SenderIp) && a.TargetIp.Equal(b.TargetIp)
+	case *IPv4Header:
+		return *a == *b.(*IPv4Header)
+	case *IPv6Header:
+		b := b.(*IPv6Header)
+		return a.SourceIp == b.SourceIp && a.DestIp == b.DestIp && a.Protocol == b.Protocol && slices.Equal(a.Payload, b.Payload)
+	case *ICMPPacket:
+		b := b.(*ICMPPacket)
+		return a.Type == b.Type && a.Id == b.Id && a.Seq == b.Seq && slices.Equal(a.Payload, b.Payload)
+	case *UDPHeader:
+		return *a == *b.(*UDPHeader)
+	}
+	return false
+}
+
+func TestDecodingLayerParserStops(t *testing.T) {
+	// no IPv4 layer in the parser, so it stops after the ethernet header
+	var eth EthernetHeader
+	var icmp ICMPPacket
+	parser := NewDecodingLayerParser(LayerTypeEthernet, &eth, &icmp)
+	var decoded []LayerType
+	if err := parser.DecodeLayers(icmpTestFrame(t), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(decoded, []LayerType{LayerTypeEthernet}) {
+		t.Fatalf("decoded %v, want only ethernet", decoded)
+	}
+
+	// a broken layer is an error, the layers before it are still decoded
+	frame := icmpTestFrame(t)
+	if err := parser.DecodeLayers(frame[:10], &decoded); err == nil {
+		t.Fatal("decoding a short frame did not fail")
+	}
+}
+
+func TestDecodingLayerParserAllocs(t *testing.T) {
+	p := newTestParser()
+	for _, frame := range [][]byte{icmpTestFrame(t), udpTestFrame(t), arpTestFrame(t)} {
+		allocs := testing.AllocsPerRun(100, func() {
+			if err := p.parser.DecodeLayers(frame, &p.decoded); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("DecodeLayers of %v allocated %v times per frame", p.decoded, allocs)
+		}
+	}
+}
+
+func benchmarkDecodeLayers(b *testing.B, frame []byte) {
+	p := newTestParser()
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := p.parser.DecodeLayers(frame, &p.decoded); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeLayersICMP(b *testing.B) { benchmarkDecodeLayers(b, icmpTestFrame(b)) }
+func BenchmarkDecodeLayersUDP(b *testing.B)  { benchmarkDecodeLayers(b, udpTestFrame(b)) }
+func BenchmarkDecodeLayersARP(b *testing.B)  { benchmarkDecodeLayers(b, arpTestFrame(b)) }
+
+// the allocating Decode, for comparison
+func BenchmarkPacketDecodeICMP(b *testing.B) {
+	frame := icmpTestFrame(b)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if p := Decode(frame); p.Err != nil {
+			b.Fatal(p.Err)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package netlibk
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+)
+
+// logger for the functions that are not called on a client, it discards everything until SetLogger is called
+var pkgLogger atomic.Pointer[slog.Logger]
+
+var discardLogger = slog.New(discardHandler{})
+
+// set the logger the package level functions write their diagnostics to, nil turns the logging off again
+func SetLogger(l *slog.Logger) {
+	pkgLogger.Store(l)
+}
+
+func logger() *slog.Logger {
+	if l := pkgLogger.Load(); l != nil {
+		return l
+	}
+	return discardLogger
+}
+
+// the client logs to its own logger if it has one, otherwise to the package one
+func (c *Client) logger() *slog.Logger {
+	if c.Logger != nil {
+		return c.Logger
+	}
+	return logger()
+}
+
+// handler that drops all the records, so nothing is printed unless the caller asks for it
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
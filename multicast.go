@@ -0,0 +1,80 @@
+package netlibk
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// start receiving the frames sent to the multicast mac address
+func (rc *RawConn) JoinMulticast(group net.HardwareAddr) error {
+	if err := rc.addMembership(unix.PACKET_MR_MULTICAST, group); err != nil {
+		return fmt.Errorf("Error joining the multicast group %v: %v", group, err)
+	}
+	return nil
+}
+
+// stop receiving the frames of the multicast group joined with JoinMulticast or ListenMulticast
+func (rc *RawConn) LeaveMulticast(group net.HardwareAddr) error {
+	mreq := rc.mreq(unix.PACKET_MR_MULTICAST, group)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	for i, m := range rc.memberships {
+		if m != mreq {
+			continue
+		}
+		if err := rc.setMembership(unix.PACKET_DROP_MEMBERSHIP, &mreq); err != nil {
+			return fmt.Errorf("Error leaving the multicast group %v: %v", group, err)
+		}
+		rc.memberships = append(rc.memberships[:i], rc.memberships[i+1:]...)
+		return nil
+	}
+	return nil
+}
+
+func (rc *RawConn) mreq(typ uint16, addr net.HardwareAddr) unix.PacketMreq {
+	mreq := unix.PacketMreq{
+		Ifindex: int32(rc.ifIndex),
+		Type:    typ,
+		Alen:    uint16(len(addr)),
+	}
+	copy(mreq.Address[:], addr)
+	return mreq
+}
+
+// add the membership to the socket and remember it for the close
+func (rc *RawConn) addMembership(typ uint16, addr net.HardwareAddr) error {
+	if len(addr) > len(unix.PacketMreq{}.Address) {
+		return ErrInvalidMAC
+	}
+	mreq := rc.mreq(typ, addr)
+
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if err := rc.setMembership(unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+		return err
+	}
+	rc.memberships = append(rc.memberships, mreq)
+	return nil
+}
+
+// drop all the memberships of the socket, the errors are ignored as the socket is closing anyway
+func (rc *RawConn) dropMemberships() {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	for i := range rc.memberships {
+		rc.setMembership(unix.PACKET_DROP_MEMBERSHIP, &rc.memberships[i])
+	}
+	rc.memberships = nil
+}
+
+func (rc *RawConn) setMembership(opt int, mreq *unix.PacketMreq) error {
+	return rc.control(func(fd int) error {
+		return unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, opt, mreq)
+	})
+}
@@ -0,0 +1,412 @@
+package netlibk
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"sync"
+	"time"
+)
+
+// ICMPv6 message types
+const (
+	ICMPv6EchoRequest           uint8 = 128
+	ICMPv6EchoReply             uint8 = 129
+	ICMPv6RouterSolicitation    uint8 = 133
+	ICMPv6RouterAdvertisement   uint8 = 134
+	ICMPv6NeighborSolicitation  uint8 = 135
+	ICMPv6NeighborAdvertisement uint8 = 136
+)
+
+// neighbor discovery option types
+const (
+	NDPOptionSourceLinkAddr uint8 = 1
+	NDPOptionTargetLinkAddr uint8 = 2
+)
+
+// the neighbor discovery messages have to be sent and received with the max hop limit (RFC 4861)
+const ndpHopLimit = 255
+
+var (
+	// the ICMPv6 message is not the expected neighbor discovery message
+	ErrInvalidNDPMessage = errors.New("Invalid NDP message")
+	// the client has no IPv6 address to send the neighbor discovery from
+	ErrNoIPv6Source = errors.New("Error no IPv6 source address on the interface")
+)
+
+// neighbor solicitation (ICMPv6 type 135), the IPv6 counterpart of the arp request
+type NeighborSolicitation struct {
+	TargetAddr     netip.Addr
+	SourceLinkAddr net.HardwareAddr // optional source link-layer address option
+}
+
+// neighbor advertisement (ICMPv6 type 136), the IPv6 counterpart of the arp reply
+type NeighborAdvertisement struct {
+	Router         bool
+	Solicited      bool
+	Override       bool
+	TargetAddr     netip.Addr
+	TargetLinkAddr net.HardwareAddr // optional target link-layer address option
+}
+
+// the ICMPv6 message with a zero checksum, it is filled in with the IPv6 pseudo header when sending
+func (ns *NeighborSolicitation) Marshal() ([]byte, error) {
+	if !ns.TargetAddr.Is6() {
+		return nil, ErrInvalidIP
+	}
+
+	// 4 bytes type, code and checksum
+	// 4 bytes reserved
+	// 16 bytes target address
+	// N bytes options
+	b := make([]byte, 24, 24+linkAddrOptionLen(ns.SourceLinkAddr))
+	b[0] = ICMPv6NeighborSolicitation
+
+	t := ns.TargetAddr.As16()
+	copy(b[8:24], t[:])
+
+	return appendLinkAddrOption(b, NDPOptionSourceLinkAddr, ns.SourceLinkAddr), nil
+}
+
+func (ns *NeighborSolicitation) Unmarshal(b []byte) error {
+	if len(b) < 24 {
+		return io.ErrUnexpectedEOF
+	}
+	if b[0] != ICMPv6NeighborSolicitation {
+		return ErrInvalidNDPMessage
+	}
+
+	ns.TargetAddr = netip.AddrFrom16([16]byte(b[8:24]))
+	ns.SourceLinkAddr = nil
+
+	return walkNDPOptions(b[24:], func(typ uint8, data []byte) {
+		if typ == NDPOptionSourceLinkAddr {
+			ns.SourceLinkAddr = copyLinkAddr(data)
+		}
+	})
+}
+
+// the ICMPv6 message with a zero checksum, it is filled in with the IPv6 pseudo header when sending
+func (na *NeighborAdvertisement) Marshal() ([]byte, error) {
+	if !na.TargetAddr.Is6() {
+		return nil, ErrInvalidIP
+	}
+
+	b := make([]byte, 24, 24+linkAddrOptionLen(na.TargetLinkAddr))
+	b[0] = ICMPv6NeighborAdvertisement
+
+	// the flags are the highest 3 bits of the reserved field
+	if na.Router {
+		b[4] |= 0x80
+	}
+	if na.Solicited {
+		b[4] |= 0x40
+	}
+	if na.Override {
+		b[4] |= 0x20
+	}
+
+	t := na.TargetAddr.As16()
+	copy(b[8:24], t[:])
+
+	return appendLinkAddrOption(b, NDPOptionTargetLinkAddr, na.TargetLinkAddr), nil
+}
+
+func (na *NeighborAdvertisement) Unmarshal(b []byte) error {
+	if len(b) < 24 {
+		return io.ErrUnexpectedEOF
+	}
+	if b[0] != ICMPv6NeighborAdvertisement {
+		return ErrInvalidNDPMessage
+	}
+
+	na.Router = b[4]&0x80 != 0
+	na.Solicited = b[4]&0x40 != 0
+	na.Override = b[4]&0x20 != 0
+	na.TargetAddr = netip.AddrFrom16([16]byte(b[8:24]))
+	na.TargetLinkAddr = nil
+
+	return walkNDPOptions(b[24:], func(typ uint8, data []byte) {
+		if typ == NDPOptionTargetLinkAddr {
+			na.TargetLinkAddr = copyLinkAddr(data)
+		}
+	})
+}
+
+// the options are padded to 8 bytes, the length field counts the 8 byte units including type and length
+func linkAddrOptionLen(addr net.HardwareAddr) int {
+	if len(addr) == 0 {
+		return 0
+	}
+	return (2 + len(addr) + 7) / 8 * 8
+}
+
+func appendLinkAddrOption(b []byte, typ uint8, addr net.HardwareAddr) []byte {
+	n := linkAddrOptionLen(addr)
+	if n == 0 {
+		return b
+	}
+
+	opt := make([]byte, n)
+	opt[0] = typ
+	opt[1] = uint8(n / 8)
+	copy(opt[2:], addr)
+
+	return append(b, opt...)
+}
+
+// the option length is in units of 8 bytes and the address is padded up to it, how long the address
+// itself is depends on the link type (RFC 4861 4.6.1), so the whole option data is kept
+// for ethernet the option is 8 bytes and the data is exactly the 6 bytes of the mac
+func copyLinkAddr(data []byte) net.HardwareAddr {
+	return append(net.HardwareAddr(nil), data...)
+}
+
+// cut the padding off a link-layer address option, the address is as long as the interface ones
+func (c *Client) linkAddr(addr net.HardwareAddr) net.HardwareAddr {
+	if n := len(c.Iface.HardwareAddr); n > 0 && len(addr) > n {
+		return addr[:n]
+	}
+	return addr
+}
+
+// RFC 4861 7.1.1, a neighbor discovery message that was not sent with the hop limit 255 came through a router
+// (and so it is not from the link), the checksum is checked here too as the kernel does not do it for packet sockets
+func checkNDP(ip6 *IPv6Header) error {
+	if ip6.HopLimit != ndpHopLimit {
+		return fmt.Errorf("%w: hop limit %d", ErrInvalidNDPMessage, ip6.HopLimit)
+	}
+	// with the received checksum in the message the sum comes out as zero
+	if ICMPv6Checksum(ip6.SourceIp, ip6.DestIp, ip6.Payload) != 0 {
+		return fmt.Errorf("%w: bad checksum", ErrInvalidNDPMessage)
+	}
+	return nil
+}
+
+func isNDPType(typ uint8) bool {
+	return typ >= ICMPv6RouterSolicitation && typ <= ICMPv6NeighborAdvertisement
+}
+
+// call fn with the type and data (without type and length) of every option
+func walkNDPOptions(b []byte, fn func(typ uint8, data []byte)) error {
+	for len(b) > 0 {
+		if len(b) < 2 {
+			return io.ErrUnexpectedEOF
+		}
+		n := int(b[1]) * 8
+		// zero length is invalid and the message has to be dropped (RFC 4861 4.6)
+		if n == 0 {
+			return ErrInvalidNDPMessage
+		}
+		if len(b) < n {
+			return io.ErrUnexpectedEOF
+		}
+
+		fn(b[0], b[2:n])
+		b = b[n:]
+	}
+
+	return nil
+}
+
+// solicited-node multicast address of the address, ff02::1:ffXX:XXXX with the last 3 bytes of the address
+func SolicitedNodeMulticast(a netip.Addr) netip.Addr {
+	b := a.As16()
+	return netip.AddrFrom16([16]byte{
+		0xff, 0x02, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0x01, 0xff, b[13], b[14], b[15],
+	})
+}
+
+// ethernet multicast address of the IPv6 multicast address, 33:33 with the last 4 bytes of the address
+func IPv6MulticastMAC(a netip.Addr) net.HardwareAddr {
+	b := a.As16()
+	return net.HardwareAddr{0x33, 0x33, b[12], b[13], b[14], b[15]}
+}
+
+// pick the IPv6 source for the target, the address on the same prefix or the link-local one
+func (c *Client) sourceAddr6For(target netip.Addr) (netip.Addr, error) {
+	var fallback netip.Addr
+	for _, p := range c.Prefixes {
+		a := p.Addr()
+		if !a.Is6() {
+			continue
+		}
+		if p.Contains(target) {
+			return a, nil
+		}
+		// the link-local address works for any target on the link, so it is preferred
+		if !fallback.IsValid() || (a.IsLinkLocalUnicast() && !fallback.IsLinkLocalUnicast()) {
+			fallback = a
+		}
+	}
+
+	if !fallback.IsValid() {
+		return fallback, ErrNoIPv6Source
+	}
+	return fallback, nil
+}
+
+// send a neighbor solicitation for the target to its solicited-node multicast group
+func (c *Client) NeighborSolicit(target netip.Addr) error {
+	if !target.Is6() {
+		return ErrInvalidIP
+	}
+	src, err := c.sourceAddr6For(target)
+	if err != nil {
+		return err
+	}
+
+	ns := &NeighborSolicitation{
+		TargetAddr:     target,
+		SourceLinkAddr: c.SourceHardwareAddr,
+	}
+	msg, err := ns.Marshal()
+	if err != nil {
+		return err
+	}
+
+	dst := SolicitedNodeMulticast(target)
+
+	c.logger().Debug("sending neighbor solicitation", "source", src, "target", target)
+	return c.writeICMPv6(IPv6MulticastMAC(dst), src, dst, ndpHopLimit, msg)
+}
+
+// receive neighbor advertisements until one comes (the other IPv6 frames are skipped)
+// returns the advertisement with its ethernet header
+func (c *Client) ReceiveNeighborAdvertisement() (*NeighborAdvertisement, *EthernetHeader, error) {
+	for {
+		ip6, eth, _, err := c.receiveICMPv6(ICMPv6NeighborAdvertisement)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		na := new(NeighborAdvertisement)
+		if err := na.Unmarshal(ip6.Payload); err != nil {
+			c.counters.malformed.Add(1)
+			c.logger().Debug("skipping malformed neighbor advertisement", "err", err)
+			continue
+		}
+
+		c.logger().Debug("received neighbor advertisement", "target", na.TargetAddr, "mac", na.TargetLinkAddr, "solicited", na.Solicited)
+		return na, eth, nil
+	}
+}
+
+// resolve the mac address of the IPv6 address with the neighbor discovery, the IPv6 equivalent of ResolveMAC
+// the client has to be made with WithProtocol(IPv6_PROTOCOL) so the socket gets the IPv6 frames
+// it always solicits, the resolved mac is kept in the neighbor cache for Ping6
+func (c *Client) ResolveMAC6(ip netip.Addr) (net.HardwareAddr, error) {
+	for attempt := 0; ; attempt++ {
+		mac, err := c.resolveMAC6(ip)
+		// solicit again only when the advertisement did not come in time
+		if errors.Is(err, os.ErrDeadlineExceeded) && attempt < c.Retries {
+			continue
+		}
+		if err == nil {
+			c.neighbors.store(ip, mac)
+		}
+		return mac, err
+	}
+}
+
+// the mac of the neighbor from the cache, it is resolved only when it is not there or it is too old
+func (c *Client) neighborMAC(ip netip.Addr) (net.HardwareAddr, error) {
+	if mac, ok := c.neighbors.lookup(ip); ok {
+		return mac, nil
+	}
+	return c.ResolveMAC6(ip)
+}
+
+// how long a resolved neighbor is used without soliciting it again, the default reachable time of RFC 4861
+const neighborCacheTTL = 30 * time.Second
+
+type neighborEntry struct {
+	mac     net.HardwareAddr
+	expires time.Time
+}
+
+// the macs of the neighbors the client resolved, the IPv6 ones and the IPv4 next hops, the zero value is an empty cache
+// the addresses are kept without their zone, the same neighbor is asked for with and without it
+type neighborCache struct {
+	mu      sync.Mutex
+	entries map[netip.Addr]neighborEntry
+	// when the expired entries were last swept out
+	swept time.Time
+}
+
+func (nc *neighborCache) lookup(ip netip.Addr) (net.HardwareAddr, bool) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	ip = ip.WithZone("")
+	e, ok := nc.entries[ip]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(nc.entries, ip)
+		return nil, false
+	}
+	return e.mac, true
+}
+
+func (nc *neighborCache) store(ip netip.Addr, mac net.HardwareAddr) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	now := time.Now()
+	if nc.entries == nil {
+		nc.entries = make(map[netip.Addr]neighborEntry)
+	}
+	// the expired ones that were never looked up again go away here, at most once per ttl,
+	// so a long scan does not keep every neighbor it ever saw
+	if now.Sub(nc.swept) >= neighborCacheTTL {
+		for addr, e := range nc.entries {
+			if now.After(e.expires) {
+				delete(nc.entries, addr)
+			}
+		}
+		nc.swept = now
+	}
+	nc.entries[ip.WithZone("")] = neighborEntry{mac: mac, expires: now.Add(neighborCacheTTL)}
+}
+
+// forget the neighbor, it did not answer so it may have a new mac by now
+func (nc *neighborCache) remove(ip netip.Addr) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	delete(nc.entries, ip.WithZone(""))
+}
+
+func (c *Client) resolveMAC6(ip netip.Addr) (net.HardwareAddr, error) {
+	if err := c.NeighborSolicit(ip); err != nil {
+		return nil, err
+	}
+
+	// without a deadline an address that nobody has would block forever
+	if err := c.Conn.SetReadDeadline(time.Now().Add(c.scanWait())); err != nil {
+		return nil, err
+	}
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	for {
+		na, eth, err := c.ReceiveNeighborAdvertisement()
+		if err != nil {
+			return nil, err
+		}
+		// the advertisement has no zone in it, the address asked for may have one
+		if na.TargetAddr != ip.WithZone("") {
+			continue
+		}
+
+		// the option can be left out in a solicited advertisement, then the frame source is the answer
+		if na.TargetLinkAddr != nil {
+			return c.linkAddr(na.TargetLinkAddr), nil
+		}
+		return eth.SourceAddr, nil
+	}
+}
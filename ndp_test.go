@@ -0,0 +1,49 @@
+package netlibk
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestNeighborCache(t *testing.T) {
+	var nc neighborCache
+	mac := net.HardwareAddr{0x02, 0, 0, 0, 0, 9}
+
+	// the zone does not make it another neighbor
+	nc.store(netip.MustParseAddr("fe80::1%eth0"), mac)
+	for _, s := range []string{"fe80::1", "fe80::1%eth0", "fe80::1%2"} {
+		if got, ok := nc.lookup(netip.MustParseAddr(s)); !ok || !bytes.Equal(got, mac) {
+			t.Fatalf("%s: got %v, %v", s, got, ok)
+		}
+	}
+	nc.remove(netip.MustParseAddr("fe80::1%eth1"))
+	if _, ok := nc.lookup(netip.MustParseAddr("fe80::1")); ok {
+		t.Fatal("still cached after remove")
+	}
+
+	// an expired entry is dropped when it is looked up
+	old := netip.MustParseAddr("192.0.2.7")
+	nc.entries[old] = neighborEntry{mac: mac, expires: time.Now().Add(-time.Second)}
+	if _, ok := nc.lookup(old); ok {
+		t.Fatal("expired entry returned")
+	}
+	if _, ok := nc.entries[old]; ok {
+		t.Fatal("expired entry left after the lookup")
+	}
+
+	// the others are swept out by a store, but only once per ttl
+	nc.entries[old] = neighborEntry{mac: mac, expires: time.Now().Add(-time.Second)}
+	nc.swept = time.Time{}
+	nc.store(netip.MustParseAddr("192.0.2.8"), mac)
+	if _, ok := nc.entries[old]; ok {
+		t.Fatal("expired entry not swept")
+	}
+	nc.entries[old] = neighborEntry{mac: mac, expires: time.Now().Add(-time.Second)}
+	nc.store(netip.MustParseAddr("192.0.2.9"), mac)
+	if _, ok := nc.entries[old]; !ok {
+		t.Fatal("swept again before the ttl passed")
+	}
+}
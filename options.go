@@ -0,0 +1,277 @@
+package netlibk
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+// the ethernet header and two vlan tags (QinQ) that come in front of an MTU sized packet
+const frameOverhead = 14 + 2*4
+
+// size of the buffer a single frame is read into when the interface does not tell its MTU
+const defaultFrameSize = 1500 + frameOverhead
+
+// the read buffer that fits a whole frame of the interface
+func frameSizeForMTU(mtu int) int {
+	if mtu <= 0 {
+		return defaultFrameSize
+	}
+	return mtu + frameOverhead
+}
+
+// everything that can be set when creating a client through NewClient
+type clientConfig struct {
+	protocol  EtherType
+	sourceIp  net.IP
+	sourceMac net.HardwareAddr
+
+	icmpId    uint16
+	icmpIdSet bool
+	icmpSeq   uint16
+
+	frameSize   int
+	readBuffer  int
+	writeBuffer int
+	promisc     bool
+	allMulti    bool
+	multicast   []net.HardwareAddr
+
+	vlans   []VLANTag
+	auxData bool
+
+	timestamps bool
+	cooked     bool
+
+	conn net.PacketConn
+
+	logger  *slog.Logger
+	timeout time.Duration
+	retries int
+}
+
+type Option func(*clientConfig)
+
+// the protocol (ethernet type) the client socket is bound to, ARP by default
+func WithProtocol(p EtherType) Option {
+	return func(cfg *clientConfig) {
+		cfg.protocol = p
+	}
+}
+
+// use this source ip instead of the one from the network interface
+func WithSourceIP(ip net.IP) Option {
+	return func(cfg *clientConfig) {
+		cfg.sourceIp = ip
+	}
+}
+
+// use this source mac instead of the hardware address of the network interface
+func WithSourceMAC(mac net.HardwareAddr) Option {
+	return func(cfg *clientConfig) {
+		cfg.sourceMac = mac
+	}
+}
+
+// set the id of the icmp echo requests, by default it is taken from the process id
+func WithICMPID(id uint16) Option {
+	return func(cfg *clientConfig) {
+		cfg.icmpId = id
+		cfg.icmpIdSet = true
+	}
+}
+
+// set the first sequence number of the icmp echo requests, by default it is 1
+func WithICMPSeq(seq uint16) Option {
+	return func(cfg *clientConfig) {
+		cfg.icmpSeq = seq
+	}
+}
+
+// set the size of the buffer a single received frame is read into,
+// by default a whole frame of the interface MTU fits in, the longer frames are truncated
+func WithFrameSize(n int) Option {
+	return func(cfg *clientConfig) {
+		cfg.frameSize = n
+	}
+}
+
+// set the kernel socket receive and send buffer sizes
+func WithBufferSizes(read, write int) Option {
+	return func(cfg *clientConfig) {
+		cfg.readBuffer = read
+		cfg.writeBuffer = write
+	}
+}
+
+// receive also the frames that are not addressed to the interface
+func WithPromiscuous() Option {
+	return func(cfg *clientConfig) {
+		cfg.promisc = true
+	}
+}
+
+// join the multicast groups (by their mac addresses) on the client socket, see ListenMulticast
+func WithMulticast(groups ...net.HardwareAddr) Option {
+	return func(cfg *clientConfig) {
+		cfg.multicast = append(cfg.multicast, groups...)
+	}
+}
+
+// receive the frames of all the multicast groups
+func WithAllMulticast() Option {
+	return func(cfg *clientConfig) {
+		cfg.allMulti = true
+	}
+}
+
+// send the frames tagged with the vlan tags (the outer one first, so more tags make QinQ)
+func WithVLAN(tags ...VLANTag) Option {
+	return func(cfg *clientConfig) {
+		cfg.vlans = tags
+	}
+}
+
+// get back the vlan tag the kernel strips from the received frames (see ListenAuxData)
+func WithVLANAuxData() Option {
+	return func(cfg *clientConfig) {
+		cfg.auxData = true
+	}
+}
+
+// take the rtt of the pings from the kernel receive timestamps (see ListenTimestamps)
+func WithTimestamps() Option {
+	return func(cfg *clientConfig) {
+		cfg.timestamps = true
+	}
+}
+
+// open the socket in cooked mode (SockDatagram), the kernel builds and strips the link layer header,
+// so the client works on the interfaces that are not ethernet (tun, ppp, InfiniBand)
+func WithCookedMode() Option {
+	return func(cfg *clientConfig) {
+		cfg.cooked = true
+	}
+}
+
+// use the connection instead of opening a packet socket on the interface, like a TunConn,
+// the options of the socket (buffer sizes, promiscuous, multicast, vlan aux data, timestamps, cooked mode) are then not used
+// the client owns the connection once NewClient returns it and closes it on Close,
+// when NewClient fails the connection is left open and the caller has to close it
+// a client on a TAP device is not the kernel end of the link, so without WithSourceMAC it gets a random local mac
+// and its prefixes are the source ip with the subnet of the device address that contains it
+func WithConn(conn net.PacketConn) Option {
+	return func(cfg *clientConfig) {
+		cfg.conn = conn
+	}
+}
+
+// set the logger the client writes its diagnostics to
+func WithLogger(l *slog.Logger) Option {
+	return func(cfg *clientConfig) {
+		cfg.logger = l
+	}
+}
+
+// set how long to wait for a reply before giving up (or retrying), zero waits forever
+func WithTimeout(d time.Duration) Option {
+	return func(cfg *clientConfig) {
+		cfg.timeout = d
+	}
+}
+
+// set how many times a request is sent again when there is no reply before the timeout
+func WithRetries(n int) Option {
+	return func(cfg *clientConfig) {
+		cfg.retries = n
+	}
+}
+
+func defaultConfig() *clientConfig {
+	return &clientConfig{
+		protocol: ARP_PROTOCOL,
+		icmpId:   uint16(os.Getpid() & 0xffff),
+		icmpSeq:  1,
+	}
+}
+
+// create a new client on the network interface configured by the options
+func NewClient(ifi *net.Interface, opts ...Option) (*Client, error) {
+	cfg := defaultConfig()
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	var lopts []ListenOption
+	if cfg.readBuffer > 0 || cfg.writeBuffer > 0 {
+		lopts = append(lopts, ListenBufferSizes(cfg.readBuffer, cfg.writeBuffer))
+	}
+	if cfg.promisc {
+		lopts = append(lopts, ListenPromiscuous())
+	}
+	if cfg.allMulti {
+		lopts = append(lopts, ListenAllMulticast())
+	}
+	if len(cfg.multicast) > 0 {
+		lopts = append(lopts, ListenMulticast(cfg.multicast...))
+	}
+	if cfg.auxData {
+		lopts = append(lopts, ListenAuxData())
+	}
+	if cfg.timestamps {
+		lopts = append(lopts, ListenTimestamps())
+	}
+
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("Error getting the IPv4 address for the user: %v\n", err)
+	}
+
+	if cfg.conn != nil {
+		// the addresses and the mac of a tun device are of the kernel end of the link, the client is the other end
+		// so its source ip has to be given with WithSourceIP
+		if t, ok := cfg.conn.(*TunConn); ok {
+			addrs = tunClientAddrs(addrs, cfg.sourceIp)
+			if t.typ == TapDevice && cfg.sourceMac == nil {
+				cfg.sourceMac = randomLocalMAC()
+			}
+		}
+		return buildClient(ifi, cfg.conn, addrs, cfg)
+	}
+
+	// the neighbor discovery and the router advertisements come to the multicast groups
+	if cfg.protocol == IPv6_PROTOCOL {
+		lopts = append(lopts, ListenMulticast(ipv6Groups(addrs)...))
+	}
+
+	sockType := SockRaw
+	if cfg.cooked {
+		sockType = SockDatagram
+	}
+
+	conn, err := Listen(ifi, sockType, int(cfg.protocol), lopts...)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening connection for the net interface: %v\n", err)
+	}
+
+	c, err := buildClient(ifi, conn, addrs, cfg)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// the mac addresses of the all nodes group and the solicited node groups of the IPv6 addresses
+func ipv6Groups(addrs []net.Addr) []net.HardwareAddr {
+	groups := []net.HardwareAddr{IPv6MulticastMAC(IPv6AllNodes)}
+	for _, p := range getPrefixes(addrs) {
+		if p.Addr().Is6() && !p.Addr().Is4In6() {
+			groups = append(groups, IPv6MulticastMAC(SolicitedNodeMulticast(p.Addr())))
+		}
+	}
+	return groups
+}
@@ -1,23 +1,28 @@
 package netlibk
 
 import (
+	"context"
 	"fmt"
-	"log"
+	"iter"
 	"net"
+	"net/netip"
 	"strings"
 )
 
 func ParseIPInputs(ips []string) (string, string, bool, error) {
 	var addrStart, addrEnd string
 
-	// CIDR notation
+	if len(ips) == 0 || ips[0] == "" {
+		return "", "", false, ErrInvalidIP
+	}
+
+	// CIDR notation, the first and last ip of the range
 	if strings.Contains(ips[0], "/") {
-		_, _, err := net.ParseCIDR(ips[0])
+		p, err := netip.ParsePrefix(ips[0])
 		if err != nil {
-			return "", "", false, fmt.Errorf("Invalid CIDR\n")
+			return "", "", false, &AddrError{Addr: ips[0], Err: ErrInvalidCIDR}
 		}
-		// TODO: I have to somehow return the first and last ip from the CIDR range
-		return ips[0], ips[0], true, nil
+		return p.Masked().Addr().String(), lastAddr(p).String(), true, nil
 	}
 
 	addrStart = ResolveHostname(ips[0])
@@ -25,51 +30,85 @@ func ParseIPInputs(ips []string) (string, string, bool, error) {
 		return "", "", false, fmt.Errorf("Error resolving the hostname or a single IP")
 	}
 
-	if ips[1] == "" {
+	if len(ips) < 2 || ips[1] == "" {
 		addrEnd = addrStart
 	} else {
 		addrEnd = ResolveHostname(ips[1])
+		if addrEnd == "" {
+			return "", "", false, fmt.Errorf("Error resolving the end hostname or IP")
+		}
 	}
 
 	// fmt.Printf("Have the start: %v; and end: %v\n", addrStart, addrEnd)
 
+	if _, _, err := parseRange(addrStart, addrEnd); err != nil {
+		return "", "", false, err
+	}
+
 	return addrStart, addrEnd, false, nil
 }
 
 func ResolveHostname(input string) string {
 	// fmt.Println("Resolving hostname on ", input)
-	ips, err := net.LookupIP(input)
-	if err != nil || len(ips) == 0 {
-		fmt.Println("Error looking up the host to resolve")
+	res := ResolveTargets(context.Background(), []string{input}, &ResolveOptions{IPv6: true})
+	if res[0].Err != nil || len(res[0].Addrs) == 0 {
+		logger().Warn("could not resolve the host", "host", input, "err", res[0].Err)
 		return ""
 	}
-	return ips[0].String()
+	return res[0].Addrs[0].String()
 }
 
-func GenerateIPs(startIP, endIP string) []net.IP {
-	var ips []net.IP
-	// fmt.Printf("Generating from %v to %v\n", startIP, endIP)
+// error for an address input that cannot be used, it wraps one of the Err values
+type AddrError struct {
+	Addr string
+	Err  error
+}
+
+func (e *AddrError) Error() string {
+	return fmt.Sprintf("%v: %q", e.Err, e.Addr)
+}
+
+func (e *AddrError) Unwrap() error {
+	return e.Err
+}
+
+// parse the start and end of a range and check that they make a valid range
+func parseRange(startIP, endIP string) (net.IP, net.IP, error) {
 	start := net.ParseIP(startIP)
 	if start == nil {
-		log.Fatalf("Error parsing start IP: %s\n", startIP)
+		return nil, nil, &AddrError{Addr: startIP, Err: ErrInvalidIP}
 	}
 	end := net.ParseIP(endIP)
 	if end == nil {
-		log.Fatalf("Error parsing end IP: %s\n", endIP)
+		return nil, nil, &AddrError{Addr: endIP, Err: ErrInvalidIP}
 	}
 
-	for ip := start; CompareIPs(ip, end) <= 0; {
-		ips = append(ips, ip)
+	if (start.To4() == nil) != (end.To4() == nil) {
+		return nil, nil, &AddrError{Addr: startIP + "-" + endIP, Err: ErrMixedFamily}
+	}
+	if CompareIPs(start, end) > 0 {
+		return nil, nil, &AddrError{Addr: startIP + "-" + endIP, Err: ErrInvalidRange}
+	}
 
-		var ok bool
-		ip, ok = inc(ip)
-		if !ok {
-			log.Fatalf("Error incrementing IP %v\n", ip)
-		}
+	return start, end, nil
+}
+
+func GenerateIPs(startIP, endIP string) ([]net.IP, error) {
+	// fmt.Printf("Generating from %v to %v\n", startIP, endIP)
+	start, end, err := parseRange(startIP, endIP)
+	if err != nil {
+		return nil, err
+	}
+
+	s, _ := netip.AddrFromSlice(start)
+	e, _ := netip.AddrFromSlice(end)
+	seq, err := RangeAddrs(s, e)
+	if err != nil {
+		return nil, err
 	}
 	// log.Printf("Generated IPs to from %v to %v ... \n", startIP, endIP)
 
-	return ips
+	return collectIPs(seq), nil
 }
 
 func CompareIPs(ip1, ip2 net.IP) int {
@@ -87,48 +126,26 @@ func CompareIPs(ip1, ip2 net.IP) int {
 	return 0
 }
 
-func GenerateIPsFromCIDR(input string) []net.IP {
-	_, ipNet, err := net.ParseCIDR(input)
+func GenerateIPsFromCIDR(input string) ([]net.IP, error) {
+	p, err := netip.ParsePrefix(input)
 	if err != nil {
-		log.Fatalf("Error parsing CIDR: %v\n", err)
+		return nil, &AddrError{Addr: input, Err: ErrInvalidCIDR}
 	}
 
-	var ips []net.IP
-	for ip := ipNet.IP; ipNet.Contains(ip); {
-		ips = append(ips, ip)
-
-		var ok bool
-		ip, ok = inc(ip)
-		if !ok {
-			log.Fatalf("Error incrementing IP %v\n", ip)
-		}
+	seq, err := PrefixAddrs(p)
+	if err != nil {
+		return nil, err
 	}
 	// log.Printf("Generating IPs to scan from %v to %v ... \n", ips[0], ips[len(ips)-1])
 
-	return ips
+	return collectIPs(seq), nil
 }
 
-func inc(ip net.IP) (net.IP, bool) {
-	ip = ip.To16()
-	if ip == nil {
-		log.Fatalf("Invalid IP for increment: %v\n", ip)
-	}
-	newIP := make(net.IP, len(ip))
-	copy(newIP, ip)
-
-	// fmt.Printf("Incrementing IP: %v\n", ip)
-
-	// increment from the last byte
-	for i := len(newIP) - 1; i >= 0; i-- {
-		newIP[i]++
-		if newIP[i] != 0 { // No overflow, stop here
-			break
-		}
-	}
-
-	// Check for overflow
-	if newIP.Equal(net.IPv4zero) {
-		return nil, false
+// materialize the addresses as net.IP for the old slice based functions
+func collectIPs(seq iter.Seq[netip.Addr]) []net.IP {
+	var ips []net.IP
+	for a := range seq {
+		ips = append(ips, net.IP(a.AsSlice()))
 	}
-	return newIP, true
+	return ips
 }
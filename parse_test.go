@@ -0,0 +1,39 @@
+package netlibk
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseIPInputs(t *testing.T) {
+	tests := []struct {
+		ips        []string
+		start, end string
+		cidr       bool
+		err        error
+	}{
+		{[]string{"192.0.2.77/24"}, "192.0.2.0", "192.0.2.255", true, nil},
+		{[]string{"192.0.2.8/32"}, "192.0.2.8", "192.0.2.8", true, nil},
+		{[]string{"0.0.0.0/0"}, "0.0.0.0", "255.255.255.255", true, nil},
+		{[]string{"2001:db8::1/126"}, "2001:db8::", "2001:db8::3", true, nil},
+		{[]string{"192.0.2.1", "192.0.2.9"}, "192.0.2.1", "192.0.2.9", false, nil},
+		{[]string{"192.0.2.1"}, "192.0.2.1", "192.0.2.1", false, nil},
+		{[]string{"192.0.2.0/33"}, "", "", false, ErrInvalidCIDR},
+		{[]string{"192.0.2.9", "192.0.2.1"}, "", "", false, ErrInvalidRange},
+		{[]string{"192.0.2.1", "2001:db8::1"}, "", "", false, ErrMixedFamily},
+		{nil, "", "", false, ErrInvalidIP},
+	}
+
+	for _, tt := range tests {
+		start, end, cidr, err := ParseIPInputs(tt.ips)
+		if tt.err != nil {
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("%q: error %v, want %v", tt.ips, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || start != tt.start || end != tt.end || cidr != tt.cidr {
+			t.Fatalf("%q: got %s %s %v %v, want %s %s %v", tt.ips, start, end, cidr, err, tt.start, tt.end, tt.cidr)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package netlibk
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// how many names are resolved at the same time when the options don't say
+const defaultResolveConcurrency = 16
+
+// options for ResolveTargets and ReverseLookup, nil options use the defaults
+type ResolveOptions struct {
+	// resolver to use, net.DefaultResolver when nil
+	Resolver *net.Resolver
+	// also return the AAAA records, otherwise only the A records are returned
+	IPv6 bool
+	// how many lookups run in parallel, defaultResolveConcurrency when zero
+	Concurrency int
+	// timeout for a single lookup, zero means only the context limits it
+	Timeout time.Duration
+}
+
+// addresses of a name, or the error why it could not be resolved
+type ResolveResult struct {
+	Name  string
+	Addrs []netip.Addr
+	Err   error
+}
+
+// names of an address from the PTR records, or the error why there are none
+type ReverseResult struct {
+	Addr  netip.Addr
+	Names []string
+	Err   error
+}
+
+func (o *ResolveOptions) resolver() *net.Resolver {
+	if o == nil || o.Resolver == nil {
+		return net.DefaultResolver
+	}
+	return o.Resolver
+}
+
+func (o *ResolveOptions) concurrency() int {
+	if o == nil || o.Concurrency <= 0 {
+		return defaultResolveConcurrency
+	}
+	return o.Concurrency
+}
+
+// context for a single lookup with the per lookup timeout
+func (o *ResolveOptions) lookupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if o == nil || o.Timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, o.Timeout)
+}
+
+// resolve all the names in parallel, the results are in the same order as the names
+// every result has all the addresses of the name (or its own error), so one bad name does not fail the rest
+func ResolveTargets(ctx context.Context, names []string, opts *ResolveOptions) []ResolveResult {
+	results := make([]ResolveResult, len(names))
+
+	network := "ip4"
+	if opts != nil && opts.IPv6 {
+		network = "ip"
+	}
+	r := opts.resolver()
+
+	forEachParallel(len(names), opts.concurrency(), func(i int) {
+		lctx, cancel := opts.lookupContext(ctx)
+		defer cancel()
+
+		results[i].Name = names[i]
+		addrs, err := r.LookupNetIP(lctx, network, names[i])
+		if err != nil {
+			logger().Debug("could not resolve the host", "host", names[i], "err", err)
+			results[i].Err = err
+			return
+		}
+
+		for _, a := range addrs {
+			results[i].Addrs = append(results[i].Addrs, a.Unmap())
+		}
+	})
+
+	return results
+}
+
+// look up the PTR records of all the addresses in parallel, the results are in the same order as the addresses
+func ReverseLookup(ctx context.Context, addrs []netip.Addr, opts *ResolveOptions) []ReverseResult {
+	results := make([]ReverseResult, len(addrs))
+	r := opts.resolver()
+
+	forEachParallel(len(addrs), opts.concurrency(), func(i int) {
+		lctx, cancel := opts.lookupContext(ctx)
+		defer cancel()
+
+		results[i].Addr = addrs[i]
+		names, err := r.LookupAddr(lctx, addrs[i].String())
+		if err != nil {
+			logger().Debug("no reverse record for the address", "addr", addrs[i], "err", err)
+			results[i].Err = err
+			return
+		}
+		results[i].Names = names
+	})
+
+	return results
+}
+
+// run fn for every index from 0 to n with at most workers of them at once
+func forEachParallel(n, workers int, fn func(i int)) {
+	sem := make(chan struct{}, workers)
+	var wg sync.WaitGroup
+
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			fn(i)
+		}(i)
+	}
+
+	wg.Wait()
+}
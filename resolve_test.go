@@ -0,0 +1,114 @@
+package netlibk
+
+import (
+	"context"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestForEachParallel(t *testing.T) {
+	for _, tt := range []struct{ n, workers int }{{0, 4}, {1, 1}, {10, 1}, {100, 8}, {5, 16}} {
+		var running, peak atomic.Int32
+		var mu sync.Mutex
+		var done []int
+
+		forEachParallel(tt.n, tt.workers, func(i int) {
+			cur := running.Add(1)
+			for {
+				p := peak.Load()
+				if cur <= p || peak.CompareAndSwap(p, cur) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			running.Add(-1)
+
+			mu.Lock()
+			done = append(done, i)
+			mu.Unlock()
+		})
+
+		slices.Sort(done)
+		if len(done) != tt.n || (tt.n > 0 && (done[0] != 0 || done[tt.n-1] != tt.n-1)) || len(slices.Compact(done)) != tt.n {
+			t.Fatalf("n %d: ran the indexes %v", tt.n, done)
+		}
+		if int(peak.Load()) > tt.workers {
+			t.Fatalf("n %d: %d ran at once with %d workers", tt.n, peak.Load(), tt.workers)
+		}
+	}
+}
+
+// the literal addresses and the hosts file names resolve without asking a dns server
+func TestResolveTargets(t *testing.T) {
+	tests := []struct {
+		name string
+		ipv6 bool
+		want []string
+		err  bool
+	}{
+		{"192.0.2.1", false, []string{"192.0.2.1"}, false},
+		{"::ffff:192.0.2.1", false, []string{"192.0.2.1"}, false},
+		{"2001:db8::1", true, []string{"2001:db8::1"}, false},
+		{"2001:db8::1", false, nil, true},
+		{"localhost", false, []string{"127.0.0.1"}, false},
+	}
+
+	for _, ipv6 := range []bool{false, true} {
+		var names []string
+		for _, tt := range tests {
+			if tt.ipv6 == ipv6 {
+				names = append(names, tt.name)
+			}
+		}
+
+		results := ResolveTargets(context.Background(), names, &ResolveOptions{IPv6: ipv6, Concurrency: 2})
+		if len(results) != len(names) {
+			t.Fatalf("%d results for %d names", len(results), len(names))
+		}
+
+		i := 0
+		for _, tt := range tests {
+			if tt.ipv6 != ipv6 {
+				continue
+			}
+			res := results[i]
+			i++
+
+			if res.Name != tt.name {
+				t.Fatalf("result %d is for %q, want %q", i, res.Name, tt.name)
+			}
+			if (res.Err != nil) != tt.err {
+				t.Fatalf("%q: error %v, want one %v", tt.name, res.Err, tt.err)
+			}
+			if want := parseAddrs(t, tt.want...); !tt.err && !slices.Equal(res.Addrs, want) {
+				t.Fatalf("%q: got %v, want %v", tt.name, res.Addrs, want)
+			}
+		}
+	}
+}
+
+func TestResolveTargetsCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results := ResolveTargets(ctx, []string{"example.invalid", "host.example.invalid"}, nil)
+	for _, res := range results {
+		if res.Err == nil {
+			t.Fatalf("%q resolved with a canceled context to %v", res.Name, res.Addrs)
+		}
+	}
+}
+
+func TestReverseLookup(t *testing.T) {
+	addrs := parseAddrs(t, "127.0.0.1")
+	results := ReverseLookup(context.Background(), addrs, &ResolveOptions{Timeout: 5 * time.Second})
+	if len(results) != 1 || results[0].Addr != addrs[0] {
+		t.Fatalf("results %v for %v", results, addrs)
+	}
+	if results[0].Err != nil || !slices.Contains(results[0].Names, "localhost") {
+		t.Fatalf("127.0.0.1 reverse names %v, err %v", results[0].Names, results[0].Err)
+	}
+}
@@ -0,0 +1,390 @@
+package netlibk
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// default layout of the receive ring, 64 blocks of 1 MiB
+const (
+	defaultRingBlockSize    = 1 << 20
+	defaultRingBlockCount   = 64
+	defaultRingFrameSize    = 2048
+	defaultRingBlockTimeout = 64 * time.Millisecond
+
+	// the packet headers in the ring are aligned to 16 bytes (TPACKET_ALIGNMENT)
+	tpacketAlignment = 16
+	// the aligned tpacket3_hdr, the frame data of the tx ring starts after it
+	tpacketHdrLen = (unix.SizeofTpacket3Hdr + tpacketAlignment - 1) &^ (tpacketAlignment - 1)
+	// the block descriptor is the version, the offset to the private area and then the block header
+	tpacketBlockHdrOffset = 8
+)
+
+// the ring config does not fit the rules of the kernel
+var ErrInvalidRingConfig = errors.New("Error invalid ring config")
+
+// layout of the memory mapped ring (PACKET_RX_RING or PACKET_TX_RING with TPACKET_V3), zero fields take the defaults
+// the kernel fills whole blocks of the rx ring with frames and hands them over when they are full or the block timeout passes
+type RingConfig struct {
+	BlockSize  int // has to be a multiple of the page size
+	BlockCount int
+	// the rx ring has no fixed frame slots in V3, the kernel only uses it to check the sizes,
+	// the tx ring has one frame (with its header) in every slot, the block size has to be a multiple of it
+	FrameSize int
+	// how long the kernel waits with a block that is not full before handing it over (rx ring only)
+	BlockTimeout time.Duration
+}
+
+// read the frames from a memory mapped TPACKET_V3 ring instead of one recvfrom syscall per frame,
+// the frames come with their kernel timestamps (see RawConn.ReadFrame)
+func ListenRxRing(cfg RingConfig) ListenOption {
+	return func(lc *listenConfig) {
+		lc.rxRing = &cfg
+	}
+}
+
+// what the kernel tells about the received frame
+type FrameInfo struct {
+	// when the kernel received the frame, by the system clock so it can be compared with time.Now
+	Timestamp time.Time
+	// when the network card received the frame, set only with ListenHardwareTimestamps
+	// it is by the clock of the card (PHC), which is not the system clock, so compare it only with other hardware timestamps
+	HardwareTimestamp time.Time
+	// length of the frame on the wire, more than the read length when the frame did not fit
+	Length int
+	// the frame did not fit into the read buffer (or the ring frame), only its start was read
+	Truncated bool
+	// the kernel dropped frames before this one because the ring was full
+	Losing bool
+}
+
+// counters of the socket from the kernel (PACKET_STATISTICS), summed up since the socket was opened
+type SocketStats struct {
+	Packets uint64 // frames that came to the socket, the dropped ones included
+	Drops   uint64 // frames dropped because the socket buffer or the ring was full
+	// how many times the ring got full and the kernel had to wait for us (TPACKET_V3 ring only)
+	FreezeCount uint64
+}
+
+type rxRing struct {
+	mu sync.Mutex
+
+	mem        []byte
+	blockSize  int
+	blockCount int
+
+	// the block we are reading, the next packet in it and its offset
+	block int
+	pkt   uint32
+	off   uint32
+}
+
+func (cfg RingConfig) withDefaults() RingConfig {
+	if cfg.BlockSize <= 0 {
+		cfg.BlockSize = defaultRingBlockSize
+	}
+	if cfg.BlockCount <= 0 {
+		cfg.BlockCount = defaultRingBlockCount
+	}
+	if cfg.FrameSize <= 0 {
+		cfg.FrameSize = defaultRingFrameSize
+	}
+	if cfg.BlockTimeout <= 0 {
+		cfg.BlockTimeout = defaultRingBlockTimeout
+	}
+	return cfg
+}
+
+// switch the socket to TPACKET_V3, set up the rings and map them, the rx ring comes first in the mapping
+// the returned memory is the whole mapping, it is unmapped with unix.Munmap on close
+func setupRings(fd int, rxCfg, txCfg *RingConfig) ([]byte, *rxRing, *txRing, error) {
+	var rxReq, txReq *unix.TpacketReq3
+	if rxCfg != nil {
+		cfg := rxCfg.withDefaults()
+		if !cfg.valid() {
+			return nil, nil, nil, ErrInvalidRingConfig
+		}
+		rxReq = cfg.req()
+		rxReq.Retire_blk_tov = uint32(cfg.BlockTimeout.Milliseconds())
+	}
+	if txCfg != nil {
+		cfg := txCfg.withDefaults()
+		if !cfg.valid() {
+			return nil, nil, nil, ErrInvalidRingConfig
+		}
+		// the kernel refuses the block timeout for the tx ring
+		txReq = cfg.req()
+	}
+
+	if err := syscall.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V3); err != nil {
+		return nil, nil, nil, fmt.Errorf("Error setting the TPACKET_V3 version: %v", err)
+	}
+
+	size := 0
+	if rxReq != nil {
+		if err := unix.SetsockoptTpacketReq3(fd, unix.SOL_PACKET, unix.PACKET_RX_RING, rxReq); err != nil {
+			return nil, nil, nil, fmt.Errorf("Error setting up the rx ring: %v", err)
+		}
+		size += int(rxReq.Block_size * rxReq.Block_nr)
+	}
+	rxSize := size
+	if txReq != nil {
+		if err := unix.SetsockoptTpacketReq3(fd, unix.SOL_PACKET, unix.PACKET_TX_RING, txReq); err != nil {
+			return nil, nil, nil, fmt.Errorf("Error setting up the tx ring: %v", err)
+		}
+		size += int(txReq.Block_size * txReq.Block_nr)
+	}
+
+	mem, err := unix.Mmap(fd, 0, size, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("Error mapping the rings: %v", err)
+	}
+
+	var rx *rxRing
+	if rxReq != nil {
+		rx = &rxRing{
+			mem:        mem[:rxSize],
+			blockSize:  int(rxReq.Block_size),
+			blockCount: int(rxReq.Block_nr),
+		}
+	}
+	var tx *txRing
+	if txReq != nil {
+		tx = &txRing{
+			mem:            mem[rxSize:],
+			blockSize:      int(txReq.Block_size),
+			frameSize:      int(txReq.Frame_size),
+			framesPerBlock: int(txReq.Block_size / txReq.Frame_size),
+			frameCount:     int(txReq.Frame_nr),
+			taken:          make([]bool, txReq.Frame_nr),
+		}
+	}
+
+	return mem, rx, tx, nil
+}
+
+// the sizes the kernel accepts
+func (cfg RingConfig) valid() bool {
+	return cfg.BlockSize%os.Getpagesize() == 0 && cfg.FrameSize%tpacketAlignment == 0 &&
+		cfg.FrameSize > tpacketHdrLen && cfg.BlockSize%cfg.FrameSize == 0
+}
+
+func (cfg RingConfig) req() *unix.TpacketReq3 {
+	return &unix.TpacketReq3{
+		Block_size: uint32(cfg.BlockSize),
+		Block_nr:   uint32(cfg.BlockCount),
+		Frame_size: uint32(cfg.FrameSize),
+		Frame_nr:   uint32(cfg.BlockSize / cfg.FrameSize * cfg.BlockCount),
+	}
+}
+
+// the header of the block, the status is shared with the kernel so it is only touched atomically
+func (r *rxRing) blockHdr(block int) *unix.TpacketHdrV1 {
+	return (*unix.TpacketHdrV1)(unsafe.Pointer(&r.mem[block*r.blockSize+tpacketBlockHdrOffset]))
+}
+
+// copy the next frame of the ring into b, EAGAIN when the kernel has not given us a block yet
+// the sender address is from the sockaddr_ll the kernel puts after the packet header
+func (r *rxRing) next(b []byte) (int, *Address, FrameInfo, *unix.Tpacket3Hdr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for {
+		hdr := r.blockHdr(r.block)
+		if atomic.LoadUint32(&hdr.Block_status)&unix.TP_STATUS_USER == 0 {
+			return 0, nil, FrameInfo{}, nil, unix.EAGAIN
+		}
+
+		if r.pkt == 0 {
+			r.off = hdr.Offset_to_first_pkt
+		}
+		if r.pkt >= hdr.Num_pkts {
+			// all the frames of the block were read, give it back to the kernel
+			atomic.StoreUint32(&hdr.Block_status, unix.TP_STATUS_KERNEL)
+			r.block = (r.block + 1) % r.blockCount
+			r.pkt = 0
+			continue
+		}
+
+		base := r.block * r.blockSize
+		ph := (*unix.Tpacket3Hdr)(unsafe.Pointer(&r.mem[base+int(r.off)]))
+		start := base + int(r.off) + int(ph.Mac)
+		n := copy(b, r.mem[start:start+int(ph.Snaplen)])
+
+		info := FrameInfo{
+			Length: int(ph.Len),
+			Losing: ph.Status&unix.TP_STATUS_LOSING != 0,
+		}
+		// the ring has room for one timestamp, the one of the card when it stamped the frame,
+		// then the system time is left for ReadFrame to fill in
+		ts := time.Unix(int64(ph.Sec), int64(ph.Nsec))
+		if ph.Status&unix.TP_STATUS_TS_RAW_HARDWARE != 0 {
+			info.HardwareTimestamp = ts
+		} else {
+			info.Timestamp = ts
+		}
+		sll := (*unix.RawSockaddrLinklayer)(unsafe.Pointer(&r.mem[base+int(r.off)+tpacketHdrLen]))
+		from := rawLinkAddress(sll)
+
+		// the header is copied, the slot is reused by the kernel once the block is given back
+		h := *ph
+
+		r.off += ph.Next_offset
+		r.pkt++
+
+		return n, from, info, &h, nil
+	}
+}
+
+// read a frame with what the kernel knows about it, from the ring when the socket has one
+// without the ring and without ListenTimestamps the timestamp is the time the read returned
+func (rc *RawConn) ReadFrame(b []byte) (int, FrameInfo, error) {
+	n, _, info, err := rc.readFrom(b)
+	if err != nil {
+		return 0, FrameInfo{}, err
+	}
+	if info.Timestamp.IsZero() {
+		info.Timestamp = time.Now()
+	}
+	return n, info, nil
+}
+
+// read the next frame with its sender, from the ring, with recvmsg or with recvfrom
+func (rc *RawConn) readFrom(b []byte) (int, *Address, FrameInfo, error) {
+	if rc.rx != nil {
+		return rc.readRing(b)
+	}
+
+	var n int
+	var from syscall.Sockaddr
+	var info FrameInfo
+	err := rc.read(func(fd int) error {
+		var err error
+		if rc.readsMsg() {
+			n, from, info, err = readMsg(fd, b)
+			return err
+		}
+		// with MSG_TRUNC the kernel returns the whole length of the frame, not only what fit into b
+		n, from, err = syscall.Recvfrom(fd, b, syscall.MSG_TRUNC)
+		info = FrameInfo{Length: n}
+		n = min(n, len(b))
+		return err
+	})
+	if err != nil {
+		return 0, nil, FrameInfo{}, err
+	}
+	info.Truncated = info.Length > n
+	return n, linkAddress(from), info, nil
+}
+
+// read the next frame from the ring, the poller wakes us up when the kernel gives a block back
+func (rc *RawConn) readRing(b []byte) (int, *Address, FrameInfo, error) {
+	var n int
+	var from *Address
+	var info FrameInfo
+	err := rc.read(func(fd int) error {
+		var err error
+		n, from, info, err = rc.nextRing(b)
+		if err == unix.EAGAIN {
+			return socketError(fd)
+		}
+		return err
+	})
+	if err != nil {
+		return 0, nil, FrameInfo{}, err
+	}
+	return n, from, info, nil
+}
+
+// take the next frame of the ring and put back the vlan tag the kernel stripped into the packet header
+func (rc *RawConn) nextRing(b []byte) (int, *Address, FrameInfo, error) {
+	n, from, info, ph, err := rc.rx.next(b)
+	if err != nil {
+		return 0, nil, FrameInfo{}, err
+	}
+
+	// same as with the aux data
+	if rc.auxData && ph.Status&unix.TP_STATUS_VLAN_VALID != 0 {
+		tag := VLANTag{TPID: VLAN_PROTOCOL}
+		if ph.Status&unix.TP_STATUS_VLAN_TPID_VALID != 0 {
+			tag.TPID = EtherType(ph.Hv1.Vlan_tpid)
+		}
+		tag.setTCI(uint16(ph.Hv1.Vlan_tci))
+		n = insertVLANTag(b, n, tag)
+		info.Length += 4
+	}
+
+	info.Truncated = info.Length > n
+	return n, from, info, nil
+}
+
+// take a reference to the ring memory, so it stays mapped while the caller uses it
+func (rc *RawConn) acquireRing() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.closed.Load() || rc.ringMem == nil {
+		return net.ErrClosed
+	}
+	rc.ringRefs++
+	return nil
+}
+
+// release a reference to the ring memory, the last one unmaps it
+func (rc *RawConn) releaseRing() error {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.ringMem == nil {
+		return nil
+	}
+	rc.ringRefs--
+	if rc.ringRefs > 0 {
+		return nil
+	}
+	mem := rc.ringMem
+	rc.ringMem = nil
+	return unix.Munmap(mem)
+}
+
+// the kernel counters of the socket, the kernel resets them on every read so they are summed up here
+func (rc *RawConn) Stats() (SocketStats, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+
+	if rc.rx != nil {
+		var st *unix.TpacketStatsV3
+		err := rc.control(func(fd int) (err error) {
+			st, err = unix.GetsockoptTpacketStatsV3(fd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
+			return err
+		})
+		if err != nil {
+			return SocketStats{}, fmt.Errorf("Error getting the socket statistics: %v", err)
+		}
+		rc.stats.Packets += uint64(st.Packets)
+		rc.stats.Drops += uint64(st.Drops)
+		rc.stats.FreezeCount += uint64(st.Freeze_q_cnt)
+	} else {
+		var st *unix.TpacketStats
+		err := rc.control(func(fd int) (err error) {
+			st, err = unix.GetsockoptTpacketStats(fd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
+			return err
+		})
+		if err != nil {
+			return SocketStats{}, fmt.Errorf("Error getting the socket statistics: %v", err)
+		}
+		rc.stats.Packets += uint64(st.Packets)
+		rc.stats.Drops += uint64(st.Drops)
+	}
+
+	return rc.stats, nil
+}
@@ -0,0 +1,224 @@
+package netlibk
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+// the IPv4 destination is neither on the link nor behind a gateway the interface has a route to
+var ErrNoRoute = errors.New("Error no route to the destination on the interface")
+
+// the kernel routing table, the addresses in it are hex numbers in the host byte order
+const procRoute = "/proc/net/route"
+
+// the route flags of /proc/net/route
+const (
+	routeUp      = 0x1
+	routeGateway = 0x2
+)
+
+// ethernet multicast address of the IPv4 multicast address, 01:00:5e with the low 23 bits of the address
+func IPv4MulticastMAC(a netip.Addr) (net.HardwareAddr, error) {
+	a = a.Unmap()
+	if !a.Is4() || !a.IsMulticast() {
+		return nil, ErrInvalidIP
+	}
+	b := a.As4()
+	return net.HardwareAddr{0x01, 0x00, 0x5e, b[1] & 0x7f, b[2], b[3]}, nil
+}
+
+// the mac the IPv4 packet to the destination is sent to, the destination's own when it is on the link
+// and the gateway's otherwise, resolved with arp and kept in the neighbor cache
+// interfaces without hardware addresses (tun, ppp) need none, so it is nil for them
+func (c *Client) nextHopMAC(dest netip.Addr) (net.HardwareAddr, error) {
+	if len(c.Iface.HardwareAddr) == 0 {
+		return nil, nil
+	}
+	switch {
+	case dest.IsMulticast():
+		return IPv4MulticastMAC(dest)
+	case c.isBroadcast4(dest):
+		return EthernetBroadcast, nil
+	}
+
+	hop, err := c.nextHop(dest)
+	if err != nil {
+		return nil, err
+	}
+	if mac, ok := c.neighbors.lookup(hop); ok {
+		return mac, nil
+	}
+
+	mac, err := c.resolveNeighbor4(hop)
+	if err != nil {
+		return nil, fmt.Errorf("Error resolving the next hop %v: %v", hop, err)
+	}
+	c.neighbors.store(hop, mac)
+	return mac, nil
+}
+
+// the limited broadcast or the broadcast address of one of the client subnets
+func (c *Client) isBroadcast4(dest netip.Addr) bool {
+	if dest == netip.AddrFrom4([4]byte{255, 255, 255, 255}) {
+		return true
+	}
+	for _, p := range c.Prefixes {
+		if p.Addr().Is4() && p.Bits() < 31 && p.Contains(dest) && dest == prefixBroadcast(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// the last address of the IPv4 prefix
+func prefixBroadcast(p netip.Prefix) netip.Addr {
+	a := binary.BigEndian.Uint32(p.Masked().Addr().AsSlice())
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], a|^uint32(0)>>p.Bits())
+	return netip.AddrFrom4(b)
+}
+
+// where the packet to the IPv4 destination goes on the link, the destination itself when one of the client
+// prefixes contains it, otherwise the gateway of the longest route on the interface from the kernel table
+func (c *Client) nextHop(dest netip.Addr) (netip.Addr, error) {
+	for _, p := range c.Prefixes {
+		if p.Addr().Is4() && p.Contains(dest) {
+			return dest, nil
+		}
+	}
+
+	routes, err := readRoutes4(c.Iface.Name)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	return routeNextHop(routes, dest)
+}
+
+// the gateway of the longest matching route, the lowest metric of the same length wins,
+// a route to the link has no gateway, so the destination is the next hop itself
+func routeNextHop(routes []route4, dest netip.Addr) (netip.Addr, error) {
+	best := -1
+	for i, r := range routes {
+		if !r.dst.Contains(dest) {
+			continue
+		}
+		if best < 0 || r.dst.Bits() > routes[best].dst.Bits() ||
+			(r.dst.Bits() == routes[best].dst.Bits() && r.metric < routes[best].metric) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return netip.Addr{}, ErrNoRoute
+	}
+	if routes[best].gateway.IsValid() {
+		return routes[best].gateway, nil
+	}
+	return dest, nil
+}
+
+// an IPv4 route of the interface, the gateway is not valid for the routes to the link
+type route4 struct {
+	dst     netip.Prefix
+	gateway netip.Addr
+	metric  int
+}
+
+// the IPv4 routes of the interface that are up
+func readRoutes4(ifname string) ([]route4, error) {
+	f, err := os.Open(procRoute)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the routing table: %v", err)
+	}
+	defer f.Close()
+
+	return parseRoutes4(f, ifname)
+}
+
+// parse the routes of the interface in the /proc/net/route format
+func parseRoutes4(r io.Reader, ifname string) ([]route4, error) {
+	var routes []route4
+	sc := bufio.NewScanner(r)
+	// the first line names the columns
+	sc.Scan()
+	for sc.Scan() {
+		// Iface Destination Gateway Flags RefCnt Use Metric Mask MTU Window IRTT
+		fields := strings.Fields(sc.Text())
+		if len(fields) < 8 || fields[0] != ifname {
+			continue
+		}
+
+		flags, err := strconv.ParseUint(fields[3], 16, 16)
+		if err != nil || flags&routeUp == 0 {
+			continue
+		}
+		dst, err1 := procRouteAddr(fields[1])
+		gw, err2 := procRouteAddr(fields[2])
+		mask, err3 := procRouteAddr(fields[7])
+		metric, err4 := strconv.Atoi(fields[6])
+		if err := errors.Join(err1, err2, err3, err4); err != nil {
+			return nil, fmt.Errorf("Error parsing the route %q: %v", sc.Text(), err)
+		}
+
+		bits, _ := net.IPMask(mask.AsSlice()).Size()
+		r := route4{dst: netip.PrefixFrom(dst, bits).Masked(), metric: metric}
+		if flags&routeGateway != 0 {
+			r.gateway = gw
+		}
+		routes = append(routes, r)
+	}
+
+	return routes, sc.Err()
+}
+
+// the address is the 32 bit number of the kernel printed in hex, so its bytes are in the host order
+func procRouteAddr(s string) (netip.Addr, error) {
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return netip.Addr{}, err
+	}
+	var b [4]byte
+	binary.NativeEndian.PutUint32(b[:], uint32(v))
+	return netip.AddrFrom4(b), nil
+}
+
+// resolve the mac of the IPv4 neighbor with arp, the client socket gets only the frames of its protocol,
+// so unless it already gets the arp frames the request goes out of a socket of its own,
+// opened on the first miss and kept until the client is closed
+func (c *Client) resolveNeighbor4(ip netip.Addr) (net.HardwareAddr, error) {
+	rc, ok := c.Conn.(*RawConn)
+	if !ok || rc.protocol == ARP_PROTOCOL || rc.protocol == unix.ETH_P_ALL {
+		return c.ResolveMACAddr(ip, false)
+	}
+
+	if c.arp == nil {
+		conn, err := Listen(c.Iface, rc.sockType, int(ARP_PROTOCOL))
+		if err != nil {
+			return nil, err
+		}
+		c.arp = &Client{
+			Iface:              c.Iface,
+			Conn:               conn,
+			SourceIp:           c.SourceIp,
+			SourceHardwareAddr: c.SourceHardwareAddr,
+			Prefixes:           c.Prefixes,
+			Logger:             c.Logger,
+			Timeout:            c.Timeout,
+			Retries:            c.Retries,
+			VLANs:              c.VLANs,
+			frameSize:          c.frameSize,
+		}
+	}
+	// the timeout of the client may have changed since, a scan sets its own
+	c.arp.Timeout, c.arp.Retries = c.Timeout, c.Retries
+	return c.arp.ResolveMACAddr(ip, false)
+}
@@ -0,0 +1,155 @@
+package netlibk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+// the address as the kernel prints it in /proc/net/route
+func procRouteHex(s string) string {
+	return fmt.Sprintf("%08X", binary.NativeEndian.Uint32(netip.MustParseAddr(s).AsSlice()))
+}
+
+func routeLine(ifname, dst, gw string, flags, metric int, mask string) string {
+	return fmt.Sprintf("%s\t%s\t%s\t%04X\t0\t0\t%d\t%s\t0\t0\t0",
+		ifname, procRouteHex(dst), procRouteHex(gw), flags, metric, procRouteHex(mask))
+}
+
+func TestParseRoutes4(t *testing.T) {
+	table := strings.Join([]string{
+		"Iface\tDestination\tGateway \tFlags\tRefCnt\tUse\tMetric\tMask\t\tMTU\tWindow\tIRTT",
+		routeLine("eth0", "0.0.0.0", "192.0.2.1", routeUp|routeGateway, 100, "0.0.0.0"),
+		routeLine("eth0", "192.0.2.0", "0.0.0.0", routeUp, 0, "255.255.255.0"),
+		routeLine("eth0", "10.0.0.0", "192.0.2.254", routeUp|routeGateway, 5, "255.0.0.0"),
+		// down, and on another interface
+		routeLine("eth0", "198.51.100.0", "192.0.2.253", routeGateway, 0, "255.255.255.0"),
+		routeLine("wlan0", "0.0.0.0", "203.0.113.1", routeUp|routeGateway, 600, "0.0.0.0"),
+		// the gateway field of a route without the gateway flag is not used
+		routeLine("eth0", "203.0.113.0", "203.0.113.9", routeUp, 0, "255.255.255.128"),
+		"",
+	}, "\n")
+
+	routes, err := parseRoutes4(strings.NewReader(table), "eth0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []route4{
+		{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParseAddr("192.0.2.1"), 100},
+		{netip.MustParsePrefix("192.0.2.0/24"), netip.Addr{}, 0},
+		{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParseAddr("192.0.2.254"), 5},
+		{netip.MustParsePrefix("203.0.113.0/25"), netip.Addr{}, 0},
+	}
+	if len(routes) != len(want) {
+		t.Fatalf("got %v, want %v", routes, want)
+	}
+	for i := range want {
+		if routes[i] != want[i] {
+			t.Fatalf("route %d is %v, want %v", i, routes[i], want[i])
+		}
+	}
+
+	bad := table + "eth0\tnothex\t00000000\t0001\t0\t0\t0\t00000000\t0\t0\t0\n"
+	if _, err := parseRoutes4(strings.NewReader(bad), "eth0"); err == nil {
+		t.Fatal("no error for a route with a bad address")
+	}
+}
+
+func TestRouteNextHop(t *testing.T) {
+	routes := []route4{
+		{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParseAddr("192.0.2.1"), 100},
+		{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParseAddr("192.0.2.2"), 50},
+		{netip.MustParsePrefix("192.0.2.0/24"), netip.Addr{}, 0},
+		{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParseAddr("192.0.2.254"), 5},
+		{netip.MustParsePrefix("10.1.0.0/16"), netip.MustParseAddr("192.0.2.253"), 500},
+	}
+
+	tests := []struct {
+		dest string
+		want string
+	}{
+		{"192.0.2.77", "192.0.2.77"},
+		{"10.2.3.4", "192.0.2.254"},
+		// the longer route wins over the lower metric
+		{"10.1.3.4", "192.0.2.253"},
+		// of the default routes the one with the lower metric
+		{"8.8.8.8", "192.0.2.2"},
+	}
+	for _, tt := range tests {
+		hop, err := routeNextHop(routes, netip.MustParseAddr(tt.dest))
+		if err != nil || hop != netip.MustParseAddr(tt.want) {
+			t.Fatalf("%s: next hop %v, err %v, want %s", tt.dest, hop, err, tt.want)
+		}
+	}
+
+	if _, err := routeNextHop(routes[2:], netip.MustParseAddr("8.8.8.8")); !errors.Is(err, ErrNoRoute) {
+		t.Fatalf("error %v without a default route, want %v", err, ErrNoRoute)
+	}
+}
+
+func TestIPv4MulticastMAC(t *testing.T) {
+	tests := []struct {
+		addr string
+		want net.HardwareAddr
+	}{
+		{"224.0.0.251", net.HardwareAddr{0x01, 0x00, 0x5e, 0x00, 0x00, 0xfb}},
+		// the top bit of the second byte does not fit in the 23 bits
+		{"239.255.1.2", net.HardwareAddr{0x01, 0x00, 0x5e, 0x7f, 0x01, 0x02}},
+		{"::ffff:224.128.0.1", net.HardwareAddr{0x01, 0x00, 0x5e, 0x00, 0x00, 0x01}},
+		{"192.0.2.1", nil},
+		{"ff02::1", nil},
+	}
+	for _, tt := range tests {
+		mac, err := IPv4MulticastMAC(netip.MustParseAddr(tt.addr))
+		if tt.want == nil {
+			if !errors.Is(err, ErrInvalidIP) {
+				t.Fatalf("%s: mac %v, error %v, want %v", tt.addr, mac, err, ErrInvalidIP)
+			}
+			continue
+		}
+		if err != nil || !bytes.Equal(mac, tt.want) {
+			t.Fatalf("%s: mac %v, error %v, want %v", tt.addr, mac, err, tt.want)
+		}
+	}
+}
+
+// the destinations that need no arp request or no route lookup
+func TestNextHopMAC(t *testing.T) {
+	neighbor := net.HardwareAddr{0x02, 0, 0, 0, 0, 7}
+	c := &Client{
+		Iface:    &net.Interface{Name: "test0", HardwareAddr: testSrcMAC},
+		Prefixes: []netip.Prefix{netip.MustParsePrefix("192.0.2.2/24"), netip.MustParsePrefix("2001:db8::2/64")},
+	}
+	c.neighbors.store(netip.MustParseAddr("192.0.2.7"), neighbor)
+
+	tests := []struct {
+		dest string
+		want net.HardwareAddr
+	}{
+		{"192.0.2.7", neighbor},
+		{"192.0.2.255", EthernetBroadcast},
+		{"255.255.255.255", EthernetBroadcast},
+		{"224.0.0.1", net.HardwareAddr{0x01, 0x00, 0x5e, 0x00, 0x00, 0x01}},
+	}
+	for _, tt := range tests {
+		mac, err := c.nextHopMAC(netip.MustParseAddr(tt.dest))
+		if err != nil || !bytes.Equal(mac, tt.want) {
+			t.Fatalf("%s: mac %v, error %v, want %v", tt.dest, mac, err, tt.want)
+		}
+	}
+
+	if hop, err := c.nextHop(netip.MustParseAddr("192.0.2.200")); err != nil || hop != netip.MustParseAddr("192.0.2.200") {
+		t.Fatalf("on link next hop %v, err %v", hop, err)
+	}
+
+	// a tun device has no macs at all
+	c.Iface = &net.Interface{Name: "tun0"}
+	if mac, err := c.nextHopMAC(netip.MustParseAddr("8.8.8.8")); mac != nil || err != nil {
+		t.Fatalf("mac %v, error %v on an interface without hardware addresses", mac, err)
+	}
+}
@@ -0,0 +1,312 @@
+package netlibk
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// neighbor discovery option types of the router advertisement
+const (
+	NDPOptionPrefixInfo uint8 = 3
+	NDPOptionMTU        uint8 = 5
+	NDPOptionRDNSS      uint8 = 25
+)
+
+var (
+	// all the nodes on the link, the IPv6 replacement of the broadcast
+	IPv6AllNodes = netip.MustParseAddr("ff02::1")
+	// all the routers on the link
+	IPv6AllRouters = netip.MustParseAddr("ff02::2")
+)
+
+// router solicitation (ICMPv6 type 133), asks the routers to send their advertisement right away
+type RouterSolicitation struct {
+	SourceLinkAddr net.HardwareAddr // optional source link-layer address option
+}
+
+// router advertisement (ICMPv6 type 134) with the options we care about
+type RouterAdvertisement struct {
+	CurHopLimit    uint8
+	Managed        bool // addresses are given by DHCPv6
+	Other          bool // other configuration is given by DHCPv6
+	RouterLifetime time.Duration
+	ReachableTime  time.Duration
+	RetransTimer   time.Duration
+
+	SourceLinkAddr net.HardwareAddr
+	MTU            uint32 // zero when there is no MTU option
+	Prefixes       []PrefixInfo
+	DNSServers     []RDNSS
+
+	// the address the advertisement came from, filled in by SolicitRouters
+	Router netip.Addr
+}
+
+// prefix information option of the router advertisement
+type PrefixInfo struct {
+	Prefix            netip.Prefix
+	OnLink            bool
+	Autonomous        bool // can be used for the address autoconfiguration
+	ValidLifetime     time.Duration
+	PreferredLifetime time.Duration
+}
+
+// recursive DNS server option of the router advertisement (RFC 8106)
+type RDNSS struct {
+	Lifetime time.Duration
+	Servers  []netip.Addr
+}
+
+// a host that answered the discovery on the link
+type Neighbor struct {
+	Addr         netip.Addr
+	HardwareAddr net.HardwareAddr
+}
+
+// the ICMPv6 message with a zero checksum, it is filled in with the IPv6 pseudo header when sending
+func (rs *RouterSolicitation) Marshal() ([]byte, error) {
+	// 4 bytes type, code and checksum
+	// 4 bytes reserved
+	// N bytes options
+	b := make([]byte, 8, 8+linkAddrOptionLen(rs.SourceLinkAddr))
+	b[0] = ICMPv6RouterSolicitation
+
+	return appendLinkAddrOption(b, NDPOptionSourceLinkAddr, rs.SourceLinkAddr), nil
+}
+
+func (rs *RouterSolicitation) Unmarshal(b []byte) error {
+	if len(b) < 8 {
+		return io.ErrUnexpectedEOF
+	}
+	if b[0] != ICMPv6RouterSolicitation {
+		return ErrInvalidNDPMessage
+	}
+
+	rs.SourceLinkAddr = nil
+	return walkNDPOptions(b[8:], func(typ uint8, data []byte) {
+		if typ == NDPOptionSourceLinkAddr {
+			rs.SourceLinkAddr = copyLinkAddr(data)
+		}
+	})
+}
+
+func (ra *RouterAdvertisement) Unmarshal(b []byte) error {
+	// 4 bytes type, code and checksum
+	// 1 byte cur hop limit
+	// 1 byte flags
+	// 2 bytes router lifetime in seconds
+	// 4 bytes reachable time in milliseconds
+	// 4 bytes retrans timer in milliseconds
+	// N bytes options
+	if len(b) < 16 {
+		return io.ErrUnexpectedEOF
+	}
+	if b[0] != ICMPv6RouterAdvertisement {
+		return ErrInvalidNDPMessage
+	}
+
+	ra.CurHopLimit = b[4]
+	ra.Managed = b[5]&0x80 != 0
+	ra.Other = b[5]&0x40 != 0
+	ra.RouterLifetime = time.Duration(binary.BigEndian.Uint16(b[6:8])) * time.Second
+	ra.ReachableTime = time.Duration(binary.BigEndian.Uint32(b[8:12])) * time.Millisecond
+	ra.RetransTimer = time.Duration(binary.BigEndian.Uint32(b[12:16])) * time.Millisecond
+
+	ra.SourceLinkAddr = nil
+	ra.MTU = 0
+	ra.Prefixes = nil
+	ra.DNSServers = nil
+
+	var optErr error
+	err := walkNDPOptions(b[16:], func(typ uint8, data []byte) {
+		switch typ {
+		case NDPOptionSourceLinkAddr:
+			ra.SourceLinkAddr = copyLinkAddr(data)
+		case NDPOptionMTU:
+			// 2 bytes reserved, 4 bytes mtu
+			if len(data) < 6 {
+				optErr = io.ErrUnexpectedEOF
+				return
+			}
+			ra.MTU = binary.BigEndian.Uint32(data[2:6])
+		case NDPOptionPrefixInfo:
+			pi, err := parsePrefixInfo(data)
+			if err != nil {
+				optErr = err
+				return
+			}
+			ra.Prefixes = append(ra.Prefixes, pi)
+		case NDPOptionRDNSS:
+			rd, err := parseRDNSS(data)
+			if err != nil {
+				optErr = err
+				return
+			}
+			ra.DNSServers = append(ra.DNSServers, rd)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	return optErr
+}
+
+// the data of the prefix information option (without type and length)
+func parsePrefixInfo(data []byte) (PrefixInfo, error) {
+	// 1 byte prefix length
+	// 1 byte flags
+	// 4 bytes valid lifetime
+	// 4 bytes preferred lifetime
+	// 4 bytes reserved
+	// 16 bytes prefix
+	if len(data) < 30 {
+		return PrefixInfo{}, io.ErrUnexpectedEOF
+	}
+
+	bits := int(data[0])
+	if bits > 128 {
+		return PrefixInfo{}, ErrInvalidNDPMessage
+	}
+
+	return PrefixInfo{
+		Prefix:            netip.PrefixFrom(netip.AddrFrom16([16]byte(data[14:30])), bits).Masked(),
+		OnLink:            data[1]&0x80 != 0,
+		Autonomous:        data[1]&0x40 != 0,
+		ValidLifetime:     ndpLifetime(binary.BigEndian.Uint32(data[2:6])),
+		PreferredLifetime: ndpLifetime(binary.BigEndian.Uint32(data[6:10])),
+	}, nil
+}
+
+// the data of the recursive DNS server option (without type and length)
+func parseRDNSS(data []byte) (RDNSS, error) {
+	// 2 bytes reserved
+	// 4 bytes lifetime
+	// 16 bytes for every server
+	if len(data) < 6 || (len(data)-6)%16 != 0 {
+		return RDNSS{}, ErrInvalidNDPMessage
+	}
+
+	rd := RDNSS{Lifetime: ndpLifetime(binary.BigEndian.Uint32(data[2:6]))}
+	for b := data[6:]; len(b) >= 16; b = b[16:] {
+		rd.Servers = append(rd.Servers, netip.AddrFrom16([16]byte(b[:16])))
+	}
+	return rd, nil
+}
+
+// the lifetimes are in seconds, all ones means infinity (returned as -1)
+func ndpLifetime(s uint32) time.Duration {
+	if s == ^uint32(0) {
+		return -1
+	}
+	return time.Duration(s) * time.Second
+}
+
+// ask the routers on the link for their advertisements and collect those that come before the timeout
+// the client has to be made with WithProtocol(IPv6_PROTOCOL)
+func (c *Client) SolicitRouters() ([]RouterAdvertisement, error) {
+	src, err := c.sourceAddr6For(IPv6AllRouters)
+	if err != nil {
+		return nil, err
+	}
+
+	rs := &RouterSolicitation{SourceLinkAddr: c.SourceHardwareAddr}
+	msg, err := rs.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	done, err := c.setCollectDeadline()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	c.logger().Debug("sending router solicitation", "source", src)
+	if err := c.writeICMPv6(IPv6MulticastMAC(IPv6AllRouters), src, IPv6AllRouters, ndpHopLimit, msg); err != nil {
+		return nil, err
+	}
+
+	var ras []RouterAdvertisement
+	for {
+		ip6, _, _, err := c.receiveICMPv6(ICMPv6RouterAdvertisement)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return ras, nil
+			}
+			return ras, err
+		}
+
+		var ra RouterAdvertisement
+		if err := ra.Unmarshal(ip6.Payload); err != nil {
+			c.counters.malformed.Add(1)
+			c.logger().Debug("skipping malformed router advertisement", "err", err)
+			continue
+		}
+		ra.Router = ip6.SourceIp
+
+		c.logger().Debug("received router advertisement", "router", ra.Router, "prefixes", len(ra.Prefixes), "mtu", ra.MTU)
+		ras = append(ras, ra)
+	}
+}
+
+// ping the all nodes multicast address and collect the hosts that reply before the timeout,
+// the IPv6 equivalent of the arp sweep over the subnet (a /64 can't be scanned address by address)
+// the client has to be made with WithProtocol(IPv6_PROTOCOL)
+func (c *Client) DiscoverHosts6(payload []byte) ([]Neighbor, error) {
+	src, err := c.sourceAddr6For(IPv6AllNodes)
+	if err != nil {
+		return nil, err
+	}
+
+	icmp, err := BuildICMPPacket(c.ICMPSeqNum, c.ICMP_ID, payload)
+	if err != nil {
+		return nil, err
+	}
+	icmp.Type = ICMPv6EchoRequest
+	c.ICMPSeqNum++
+
+	msg, err := icmp.Marshal()
+	if err != nil {
+		return nil, err
+	}
+
+	done, err := c.setCollectDeadline()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	c.logger().Debug("sending all nodes echo", "source", src, "id", icmp.Id, "seq", icmp.Seq)
+	if err := c.writeICMPv6(IPv6MulticastMAC(IPv6AllNodes), src, IPv6AllNodes, defaultHopLimit, msg); err != nil {
+		return nil, err
+	}
+
+	var hosts []Neighbor
+	seen := make(map[netip.Addr]bool)
+	for {
+		ip6, eth, _, err := c.receiveICMPv6(ICMPv6EchoReply)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				return hosts, nil
+			}
+			return hosts, err
+		}
+
+		reply := new(ICMPPacket)
+		if err := reply.Unmarshal(ip6.Payload); err != nil {
+			continue
+		}
+		if reply.Id != icmp.Id || reply.Seq != icmp.Seq || seen[ip6.SourceIp] {
+			continue
+		}
+		seen[ip6.SourceIp] = true
+
+		c.logger().Debug("discovered ipv6 host", "addr", ip6.SourceIp, "mac", eth.SourceAddr)
+		hosts = append(hosts, Neighbor{Addr: ip6.SourceIp, HardwareAddr: eth.SourceAddr})
+	}
+}
@@ -0,0 +1,160 @@
+package netlibk
+
+import (
+	"errors"
+	"iter"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+)
+
+// how long to wait for the replies after the last request of a scan when the client has no timeout
+const defaultScanWait = 2 * time.Second
+
+func (c *Client) scanWait() time.Duration {
+	if c.Timeout > 0 {
+		return c.Timeout
+	}
+	return defaultScanWait
+}
+
+// send an arp request to every IPv4 target and collect the replies into a map of ip -> mac
+// the replies are read while the requests are still being sent, and for the scan wait time after the last one
+// the targets can be any lazy address set, like TargetSet.All() or the PrefixAddrs iterator
+func (c *Client) ARPScan(targets iter.Seq[netip.Addr]) (map[netip.Addr]net.HardwareAddr, error) {
+	replies := make(map[netip.Addr]net.HardwareAddr)
+	done := make(chan error, 1)
+
+	// the reader stops when the deadline set after the wait wakes it up
+	if err := c.Conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+
+	go func() {
+		for {
+			arp, _, err := c.ReceiveARP()
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				done <- nil
+				return
+			}
+			if err != nil {
+				done <- err
+				return
+			}
+			if arp.Operation != OperationReply {
+				continue
+			}
+			if ip := arp.SenderAddr(); ip.IsValid() {
+				replies[ip] = arp.SenderHardwareAddr
+			}
+		}
+	}()
+
+	sent := make(map[netip.Addr]struct{})
+	var sendErr error
+	if bc, ok := c.Conn.(BatchConn); ok {
+		sendErr = c.sendARPBatches(bc, targets, sent)
+	} else {
+		for target := range targets {
+			if !target.Is4() {
+				continue
+			}
+			if sendErr = c.ARPRequestAddr(target); sendErr != nil {
+				break
+			}
+			sent[target] = struct{}{}
+		}
+	}
+
+	if sendErr == nil {
+		time.Sleep(c.scanWait())
+	}
+	c.Conn.SetReadDeadline(time.Now())
+	readErr := <-done
+	c.Conn.SetReadDeadline(time.Time{})
+
+	if sendErr != nil {
+		return nil, sendErr
+	}
+	if readErr != nil {
+		return nil, readErr
+	}
+
+	// keep only the replies from the scanned targets, someone else may be asking on the network too
+	for ip := range replies {
+		if _, ok := sent[ip]; !ok {
+			delete(replies, ip)
+		}
+	}
+
+	// the kernel drops tell whether the missing replies were lost on our side
+	st, _ := c.Stats()
+	c.logger().Debug("arp scan done", "sent", len(sent), "replies", len(replies),
+		"kernel_drops", st.Drops, "rejected", st.Rejected, "malformed", st.Malformed, "truncated", st.Truncated)
+	return replies, nil
+}
+
+// send the arp requests scanBatchSize at a time with one syscall for each batch
+func (c *Client) sendARPBatches(bc BatchConn, targets iter.Seq[netip.Addr], sent map[netip.Addr]struct{}) error {
+	batch := make([]Message, 0, scanBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		_, err := bc.WriteBatch(batch)
+		c.logger().Debug("sent arp request batch", "len", len(batch))
+		batch = batch[:0]
+		return err
+	}
+
+	for target := range targets {
+		if !target.Is4() {
+			continue
+		}
+		m, err := c.arpRequestMessage(target)
+		if err != nil {
+			return err
+		}
+		batch = append(batch, m)
+		sent[target] = struct{}{}
+
+		if len(batch) == scanBatchSize {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return flush()
+}
+
+// ping every IPv4 target one after another and return the response times of those that replied
+// a target that does not reply before the client timeout (or the default scan wait) is left out
+func (c *Client) PingScan(targets iter.Seq[netip.Addr], payload []byte) (map[netip.Addr]time.Duration, error) {
+	results := make(map[netip.Addr]time.Duration)
+
+	// the ping sets the deadline itself only when the client has a timeout
+	timeout := c.Timeout
+	c.Timeout = c.scanWait()
+	defer func() { c.Timeout = timeout }()
+
+	for target := range targets {
+		if !target.Is4() {
+			continue
+		}
+
+		t, active, err := c.PingAddr(target, payload)
+		if err != nil {
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue
+			}
+			return results, err
+		}
+		if active {
+			results[target] = t
+		}
+	}
+
+	return results, nil
+}
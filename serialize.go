@@ -0,0 +1,339 @@
+package netlibk
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// the layer can not be serialized (it has no SerializeTo)
+var ErrNotSerializable = errors.New("Error layer can not be serialized")
+
+// what SerializeLayers fills in for you
+type SerializeOptions struct {
+	// set the length fields (IPv4 TotalLen and IHL, IPv6 PayloadLen, UDP Length, TCP DataOffset) from the layers
+	FixLengths bool
+	// compute the IPv4, ICMP, ICMPv6, UDP and TCP checksums, the transport ones with the pseudo header of the ip layer before them
+	ComputeChecksums bool
+}
+
+// a layer that can write itself in front of the bytes already in the buffer (its payload)
+type SerializableLayer interface {
+	Layer
+	SerializeTo(buf *SerializeBuffer, opts SerializeOptions) error
+}
+
+// the buffer the layers are serialized into, they are written from the last one to the first,
+// so every layer prepends its header to its payload
+// it can be reused for more frames with Clear
+type SerializeBuffer struct {
+	data  []byte
+	start int
+	// the bytes appended since the last Clear and the most appended to one frame so far,
+	// Clear leaves that much room after the data and the rest of the memory in front of it
+	appended, tailroom int
+
+	// the ip layer in front of the layer being serialized, for the pseudo header checksums
+	network Layer
+}
+
+func NewSerializeBuffer() *SerializeBuffer {
+	return &SerializeBuffer{}
+}
+
+// the serialized bytes, they are valid until the buffer is written to or cleared
+func (buf *SerializeBuffer) Bytes() []byte {
+	return buf.data[buf.start:]
+}
+
+// make room for n bytes in front of the data and return them (they are not zeroed)
+func (buf *SerializeBuffer) PrependBytes(n int) []byte {
+	if buf.start < n {
+		// grow at the front, leave some space so the next headers don't have to copy again
+		grow := n - buf.start + 64
+		nb := make([]byte, grow+len(buf.data))
+		copy(nb[grow:], buf.data)
+		buf.start += grow
+		buf.data = nb
+	}
+	buf.start -= n
+	return buf.data[buf.start : buf.start+n]
+}
+
+// make room for n bytes after the data and return them (they are not zeroed)
+func (buf *SerializeBuffer) AppendBytes(n int) []byte {
+	buf.appended += n
+	l := len(buf.data)
+	if cap(buf.data)-l < n {
+		nb := make([]byte, l, 2*cap(buf.data)+n)
+		copy(nb, buf.data)
+		buf.data = nb
+	}
+	buf.data = buf.data[:l+n]
+	return buf.data[l:]
+}
+
+// empty the buffer, keeping the memory
+// the layers are prepended, so it is left as the headroom in front of the (empty) data,
+// but for the room the appends (the ethernet padding) needed before
+func (buf *SerializeBuffer) Clear() {
+	buf.tailroom = max(buf.tailroom, buf.appended)
+	buf.appended = 0
+	buf.start = max(cap(buf.data)-buf.tailroom, 0)
+	buf.data = buf.data[:buf.start]
+	buf.network = nil
+}
+
+// serialize the layers into the buffer (the first layer is the outermost, like in Packet.Layers),
+// the buffer is cleared first
+// to put raw bytes after the last header use a RawLayer
+func SerializeLayers(buf *SerializeBuffer, opts SerializeOptions, layers ...Layer) error {
+	buf.Clear()
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		sl, ok := layers[i].(SerializableLayer)
+		if !ok {
+			return fmt.Errorf("%w: %v", ErrNotSerializable, layers[i].LayerType())
+		}
+
+		buf.network = nil
+		for j := i - 1; j >= 0; j-- {
+			if _, ok := layers[j].(IPProtocolCarrier); ok {
+				buf.network = layers[j]
+				break
+			}
+		}
+
+		if err := sl.SerializeTo(buf, opts); err != nil {
+			return fmt.Errorf("Error serializing %v layer: %w", layers[i].LayerType(), err)
+		}
+	}
+
+	return nil
+}
+
+func (r *RawLayer) SerializeTo(buf *SerializeBuffer, opts SerializeOptions) error {
+	copy(buf.PrependBytes(len(r.Data)), r.Data)
+	return nil
+}
+
+// the payload is whatever was serialized after the header, the Payload field is not used
+// the frame is always zero-padded to the minimal ethernet length
+func (et *EthernetHeader) SerializeTo(buf *SerializeBuffer, opts SerializeOptions) error {
+	if pad := minPayloadLen - len(buf.Bytes()); pad > 0 {
+		clear(buf.AppendBytes(pad))
+	}
+
+	hdr := buf.PrependBytes(14 + 4*len(et.VLANs))
+	copy(hdr[0:6], et.DestAddr)
+	copy(hdr[6:12], et.SourceAddr)
+
+	n := 12
+	for _, tag := range et.VLANs {
+		tag.marshal(hdr[n : n+4])
+		n += 4
+	}
+	binary.BigEndian.PutUint16(hdr[n:n+2], uint16(et.EtherType))
+
+	return nil
+}
+
+func (p *ARPPacket) SerializeTo(buf *SerializeBuffer, opts SerializeOptions) error {
+	b, err := p.Marshal()
+	if err != nil {
+		return err
+	}
+	copy(buf.PrependBytes(len(b)), b)
+	return nil
+}
+
+// the header has no options, so it is always 20 bytes
+func (h *IPv4Header) SerializeTo(buf *SerializeBuffer, opts SerializeOptions) error {
+	if opts.FixLengths {
+		h.HeaderLen = 5
+		h.TotalLen = uint16(20 + len(buf.Bytes()))
+	}
+	if h.Version == 0 {
+		h.Version = 4
+	}
+
+	b := buf.PrependBytes(20)
+	h.marshalTo(b)
+	if opts.ComputeChecksums {
+		binary.BigEndian.PutUint16(b[10:12], 0)
+		h.Checksum = checksum(b)
+		binary.BigEndian.PutUint16(b[10:12], h.Checksum)
+	}
+
+	return nil
+}
+
+// the payload is whatever was serialized after the header and the extension headers, the Payload field is not used
+func (h *IPv6Header) SerializeTo(buf *SerializeBuffer, opts SerializeOptions) error {
+	if !h.SourceIp.Is6() || !h.DestIp.Is6() {
+		return ErrInvalidIP
+	}
+
+	extLen := 0
+	for _, ext := range h.ExtensionHeaders {
+		extLen += len(ext.Data)
+	}
+	if opts.FixLengths {
+		h.PayloadLen = uint16(extLen + len(buf.Bytes()))
+	}
+
+	b := buf.PrependBytes(ipv6HeaderLen + extLen)
+	binary.BigEndian.PutUint32(b[0:4], 6<<28|uint32(h.TrafficClass)<<20|h.FlowLabel&0xfffff)
+	binary.BigEndian.PutUint16(b[4:6], h.PayloadLen)
+	b[6] = h.NextHeader
+	b[7] = h.HopLimit
+
+	s, d := h.SourceIp.As16(), h.DestIp.As16()
+	copy(b[8:24], s[:])
+	copy(b[24:40], d[:])
+
+	n := ipv6HeaderLen
+	for _, ext := range h.ExtensionHeaders {
+		n += copy(b[n:], ext.Data)
+	}
+
+	return nil
+}
+
+// after an IPv6 layer the checksum is the ICMPv6 one (with the pseudo header)
+func (icmp *ICMPPacket) SerializeTo(buf *SerializeBuffer, opts SerializeOptions) error {
+	b := buf.PrependBytes(8 + len(icmp.Payload))
+	b[0] = icmp.Type
+	b[1] = icmp.Code
+	binary.BigEndian.PutUint16(b[2:4], icmp.Checksum)
+	binary.BigEndian.PutUint16(b[4:6], icmp.Id)
+	binary.BigEndian.PutUint16(b[6:8], icmp.Seq)
+	copy(b[8:], icmp.Payload)
+
+	if opts.ComputeChecksums {
+		icmp.Checksum = icmpChecksum(buf.network, buf.Bytes())
+		binary.BigEndian.PutUint16(b[2:4], icmp.Checksum)
+	}
+	return nil
+}
+
+// writes the type, code and body, the Contents are not used
+func (icmp *ICMPv6Packet) SerializeTo(buf *SerializeBuffer, opts SerializeOptions) error {
+	b := buf.PrependBytes(4 + len(icmp.Body))
+	b[0] = icmp.Type
+	b[1] = icmp.Code
+	binary.BigEndian.PutUint16(b[2:4], icmp.Checksum)
+	copy(b[4:], icmp.Body)
+
+	if opts.ComputeChecksums {
+		icmp.Checksum = icmpChecksum(buf.network, buf.Bytes())
+		binary.BigEndian.PutUint16(b[2:4], icmp.Checksum)
+	}
+	return nil
+}
+
+func (u *UDPHeader) SerializeTo(buf *SerializeBuffer, opts SerializeOptions) error {
+	if opts.FixLengths {
+		u.Length = uint16(8 + len(buf.Bytes()))
+	}
+
+	b := buf.PrependBytes(8)
+	binary.BigEndian.PutUint16(b[0:2], u.SourcePort)
+	binary.BigEndian.PutUint16(b[2:4], u.DestPort)
+	binary.BigEndian.PutUint16(b[4:6], u.Length)
+	binary.BigEndian.PutUint16(b[6:8], u.Checksum)
+
+	if opts.ComputeChecksums {
+		binary.BigEndian.PutUint16(b[6:8], 0)
+		sum, err := transportChecksum(buf.network, UDP_PROTOCOL, buf.Bytes())
+		if err != nil {
+			return err
+		}
+		// zero means no checksum for udp, so it is sent as all ones
+		if sum == 0 {
+			sum = 0xffff
+		}
+		u.Checksum = sum
+		binary.BigEndian.PutUint16(b[6:8], u.Checksum)
+	}
+	return nil
+}
+
+// the options have to be padded to 4 bytes by the caller
+func (t *TCPHeader) SerializeTo(buf *SerializeBuffer, opts SerializeOptions) error {
+	if len(t.Options)%4 != 0 {
+		return ErrInvalidSegment
+	}
+	if opts.FixLengths {
+		t.DataOffset = uint8(5 + len(t.Options)/4)
+	}
+
+	b := buf.PrependBytes(20 + len(t.Options))
+	binary.BigEndian.PutUint16(b[0:2], t.SourcePort)
+	binary.BigEndian.PutUint16(b[2:4], t.DestPort)
+	binary.BigEndian.PutUint32(b[4:8], t.Seq)
+	binary.BigEndian.PutUint32(b[8:12], t.Ack)
+	binary.BigEndian.PutUint16(b[12:14], uint16(t.DataOffset)<<12|t.Flags&0x01ff)
+	binary.BigEndian.PutUint16(b[14:16], t.Window)
+	binary.BigEndian.PutUint16(b[16:18], t.Checksum)
+	binary.BigEndian.PutUint16(b[18:20], t.Urgent)
+	copy(b[20:], t.Options)
+
+	if opts.ComputeChecksums {
+		binary.BigEndian.PutUint16(b[16:18], 0)
+		sum, err := transportChecksum(buf.network, TCP_PROTOCOL, buf.Bytes())
+		if err != nil {
+			return err
+		}
+		t.Checksum = sum
+		binary.BigEndian.PutUint16(b[16:18], t.Checksum)
+	}
+	return nil
+}
+
+// the ICMP checksum is only over the message, the ICMPv6 one also over the pseudo header
+// the checksum field of msg has to be zero
+func icmpChecksum(network Layer, msg []byte) uint16 {
+	binary.BigEndian.PutUint16(msg[2:4], 0)
+	if ip6, ok := network.(*IPv6Header); ok {
+		return ICMPv6Checksum(ip6.SourceIp, ip6.DestIp, msg)
+	}
+	return checksum(msg)
+}
+
+// the udp and tcp checksum over the pseudo header of the ip layer and the whole segment
+func transportChecksum(network Layer, protocol uint8, seg []byte) (uint16, error) {
+	switch ip := network.(type) {
+	case *IPv4Header:
+		return pseudoHeaderChecksum(ip.SourceAddr(), ip.DestAddr(), protocol, seg), nil
+	case *IPv6Header:
+		return pseudoHeaderChecksum(ip.SourceIp, ip.DestIp, protocol, seg), nil
+	}
+	return 0, fmt.Errorf("Error no ip layer for the %d checksum pseudo header", protocol)
+}
+
+// checksum over the pseudo header (addresses, protocol and length) followed by the segment
+func pseudoHeaderChecksum(src, dst netip.Addr, protocol uint8, seg []byte) uint16 {
+	if src.Is4() {
+		// 4 bytes source, 4 bytes destination, 1 byte zero, 1 byte protocol, 2 bytes length
+		b := make([]byte, 12+len(seg))
+		s, d := src.As4(), dst.As4()
+		copy(b[0:4], s[:])
+		copy(b[4:8], d[:])
+		b[9] = protocol
+		binary.BigEndian.PutUint16(b[10:12], uint16(len(seg)))
+		copy(b[12:], seg)
+		return checksum(b)
+	}
+
+	// 16 bytes source, 16 bytes destination, 4 bytes length, 3 bytes zero, 1 byte next header
+	b := make([]byte, 40+len(seg))
+	s, d := src.As16(), dst.As16()
+	copy(b[0:16], s[:])
+	copy(b[16:32], d[:])
+	binary.BigEndian.PutUint32(b[32:36], uint32(len(seg)))
+	b[39] = protocol
+	copy(b[40:], seg)
+	return checksum(b)
+}
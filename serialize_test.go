@@ -0,0 +1,219 @@
+package netlibk
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/netip"
+	"slices"
+	"testing"
+)
+
+var (
+	testSrcMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	testDstMAC = net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+)
+
+func serializeTestFrame(tb testing.TB, layers ...Layer) []byte {
+	tb.Helper()
+
+	buf := NewSerializeBuffer()
+	if err := SerializeLayers(buf, SerializeOptions{FixLengths: true, ComputeChecksums: true}, layers...); err != nil {
+		tb.Fatal(err)
+	}
+	return slices.Clone(buf.Bytes())
+}
+
+// a checksum over data that has its own checksum in it comes out as zero
+func TestSerializeChecksums(t *testing.T) {
+	src4, dst4 := [4]byte{192, 0, 2, 2}, [4]byte{192, 0, 2, 1}
+	src6, dst6 := netip.MustParseAddr("fd00::2"), netip.MustParseAddr("fd00::1")
+
+	tests := []struct {
+		name   string
+		layers []Layer
+		types  []LayerType
+	}{
+		{
+			"icmp",
+			[]Layer{
+				&EthernetHeader{DestAddr: testDstMAC, SourceAddr: testSrcMAC, EtherType: IPv4_PROTOCOL},
+				&IPv4Header{TTL: 64, Protocol: ICMP_PROTOCOL, SourceIp: src4, DestIp: dst4},
+				&ICMPPacket{Type: 8, Id: 0x1234, Seq: 7, Payload: []byte("ping payload")},
+			},
+			[]LayerType{LayerTypeEthernet, LayerTypeIPv4, LayerTypeICMP},
+		},
+		{
+			"tcp",
+			[]Layer{
+				&EthernetHeader{DestAddr: testDstMAC, SourceAddr: testSrcMAC, EtherType: IPv4_PROTOCOL},
+				&IPv4Header{TTL: 64, Protocol: TCP_PROTOCOL, SourceIp: src4, DestIp: dst4},
+				&TCPHeader{SourcePort: 40000, DestPort: 80, Seq: 1, Flags: TCPFlagSYN, Window: 1024, Options: []byte{2, 4, 5, 0xb4}},
+				&RawLayer{Data: []byte("odd length")},
+			},
+			[]LayerType{LayerTypeEthernet, LayerTypeIPv4, LayerTypeTCP, LayerTypeRaw},
+		},
+		{
+			"udp6 vlan",
+			[]Layer{
+				&EthernetHeader{DestAddr: testDstMAC, SourceAddr: testSrcMAC, VLANs: []VLANTag{{TPID: QinQ_PROTOCOL, VID: 100}, {TPID: VLAN_PROTOCOL, VID: 10}}, EtherType: IPv6_PROTOCOL},
+				&IPv6Header{HopLimit: 64, NextHeader: UDP_PROTOCOL, Protocol: UDP_PROTOCOL, SourceIp: src6, DestIp: dst6},
+				&UDPHeader{SourcePort: 5353, DestPort: 53},
+				&RawLayer{Data: []byte("udp payload")},
+			},
+			[]LayerType{LayerTypeEthernet, LayerTypeVLAN, LayerTypeVLAN, LayerTypeIPv6, LayerTypeUDP, LayerTypeRaw},
+		},
+		{
+			"icmpv6",
+			[]Layer{
+				&EthernetHeader{DestAddr: testDstMAC, SourceAddr: testSrcMAC, EtherType: IPv6_PROTOCOL},
+				&IPv6Header{HopLimit: 64, NextHeader: ICMPv6_PROTOCOL, Protocol: ICMPv6_PROTOCOL, SourceIp: src6, DestIp: dst6},
+				&ICMPv6Packet{Type: 128, Body: []byte{0x12, 0x34, 0, 1, 'p', 'i', 'n', 'g'}},
+			},
+			[]LayerType{LayerTypeEthernet, LayerTypeIPv6, LayerTypeICMPv6},
+		},
+	}
+
+	for _, tt := range tests {
+		b := serializeTestFrame(t, tt.layers...)
+		p := Decode(b)
+		if p.Err != nil {
+			t.Fatalf("%s: decoding the serialized frame: %v", tt.name, p.Err)
+		}
+
+		var types []LayerType
+		for _, l := range p.Layers {
+			types = append(types, l.LayerType())
+		}
+		if !slices.Equal(types, tt.types) {
+			t.Fatalf("%s: decoded %v, want %v", tt.name, types, tt.types)
+		}
+
+		eth := p.Layer(LayerTypeEthernet).(*EthernetHeader)
+		if len(b) < 14+4*len(eth.VLANs)+minPayloadLen {
+			t.Fatalf("%s: frame of %d bytes is not padded", tt.name, len(b))
+		}
+
+		// the transport layer starts where the ip header ends
+		var seg []byte
+		var src, dst netip.Addr
+		if ip4, ok := p.Layer(LayerTypeIPv4).(*IPv4Header); ok {
+			hdr := eth.Payload[:int(ip4.HeaderLen)*4]
+			if checksum(hdr) != 0 {
+				t.Fatalf("%s: bad IPv4 header checksum %#04x", tt.name, ip4.Checksum)
+			}
+			if int(ip4.TotalLen) > len(eth.Payload) {
+				t.Fatalf("%s: total length %d over the %d bytes of payload", tt.name, ip4.TotalLen, len(eth.Payload))
+			}
+			seg = eth.Payload[len(hdr):ip4.TotalLen]
+			src, dst = ip4.SourceAddr(), ip4.DestAddr()
+		}
+		if ip6, ok := p.Layer(LayerTypeIPv6).(*IPv6Header); ok {
+			seg = eth.Payload[ipv6HeaderLen : ipv6HeaderLen+int(ip6.PayloadLen)]
+			src, dst = ip6.SourceIp, ip6.DestIp
+		}
+
+		switch tt.types[len(eth.VLANs)+2] {
+		case LayerTypeICMP:
+			if checksum(seg) != 0 {
+				t.Fatalf("%s: bad ICMP checksum", tt.name)
+			}
+		case LayerTypeICMPv6:
+			if ICMPv6Checksum(src, dst, seg) != 0 {
+				t.Fatalf("%s: bad ICMPv6 checksum", tt.name)
+			}
+		case LayerTypeUDP:
+			if pseudoHeaderChecksum(src, dst, UDP_PROTOCOL, seg) != 0 {
+				t.Fatalf("%s: bad UDP checksum", tt.name)
+			}
+			if udp := p.Layer(LayerTypeUDP).(*UDPHeader); int(udp.Length) != len(seg) {
+				t.Fatalf("%s: udp length %d, want %d", tt.name, udp.Length, len(seg))
+			}
+		case LayerTypeTCP:
+			if pseudoHeaderChecksum(src, dst, TCP_PROTOCOL, seg) != 0 {
+				t.Fatalf("%s: bad TCP checksum", tt.name)
+			}
+			if tcp := p.Layer(LayerTypeTCP).(*TCPHeader); tcp.DataOffset != 6 || !bytes.Equal(tcp.Options, []byte{2, 4, 5, 0xb4}) {
+				t.Fatalf("%s: data offset %d and options %v", tt.name, tcp.DataOffset, tcp.Options)
+			}
+		}
+	}
+}
+
+func TestSerializeRoundTrip(t *testing.T) {
+	arp, err := BuildARPPacketAddr(OperationRequest, netip.MustParseAddr("192.0.2.2"), netip.MustParseAddr("192.0.2.1"), testSrcMAC, EthernetBroadcast)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := serializeTestFrame(t, &EthernetHeader{DestAddr: EthernetBroadcast, SourceAddr: testSrcMAC, EtherType: ARP_PROTOCOL}, arp)
+	if len(b) != 14+minPayloadLen {
+		t.Fatalf("arp frame of %d bytes, want it padded to %d", len(b), 14+minPayloadLen)
+	}
+
+	got, ok := Decode(b).Layer(LayerTypeARP).(*ARPPacket)
+	if !ok {
+		t.Fatal("no arp layer in the serialized frame")
+	}
+	if got.Operation != OperationRequest || got.SenderAddr() != arp.SenderAddr() || got.TargetAddr() != arp.TargetAddr() ||
+		!bytes.Equal(got.SenderHardwareAddr, testSrcMAC) {
+		t.Fatalf("decoded %+v, want %+v", got, arp)
+	}
+
+	// serializing the decoded layers again gives the same frame
+	icmp := serializeTestFrame(t,
+		&EthernetHeader{DestAddr: testDstMAC, SourceAddr: testSrcMAC, EtherType: IPv4_PROTOCOL},
+		&IPv4Header{TTL: 64, Id: 99, Protocol: ICMP_PROTOCOL, SourceIp: [4]byte{192, 0, 2, 2}, DestIp: [4]byte{192, 0, 2, 1}},
+		&ICMPPacket{Type: 8, Id: 1, Seq: 2, Payload: []byte("some payload that is long enough not to be padded")},
+	)
+	p := Decode(icmp)
+	again := serializeTestFrame(t, p.Layers[0], p.Layers[1], &ICMPPacket{
+		Type: 8, Id: 1, Seq: 2, Payload: p.Layers[2].(*ICMPPacket).Payload,
+	})
+	if !bytes.Equal(icmp, again) {
+		t.Fatalf("serialized again\n%x\nwant\n%x", again, icmp)
+	}
+}
+
+func TestSerializeBuffer(t *testing.T) {
+	buf := NewSerializeBuffer()
+	copy(buf.PrependBytes(3), "def")
+	copy(buf.PrependBytes(100), bytes.Repeat([]byte("a"), 100))
+	copy(buf.AppendBytes(2), "gh")
+	copy(buf.PrependBytes(2), "bc")
+
+	want := "bc" + string(bytes.Repeat([]byte("a"), 100)) + "defgh"
+	if string(buf.Bytes()) != want {
+		t.Fatalf("got %q, want %q", buf.Bytes(), want)
+	}
+
+	buf.Clear()
+	if len(buf.Bytes()) != 0 {
+		t.Fatalf("%d bytes left after clear", len(buf.Bytes()))
+	}
+	copy(buf.PrependBytes(2), "xy")
+	if string(buf.Bytes()) != "xy" {
+		t.Fatalf("got %q after clear, want %q", buf.Bytes(), "xy")
+	}
+
+	// the memory is reused for the next frames, the padded ones too
+	layers := []Layer{
+		&EthernetHeader{DestAddr: testDstMAC, SourceAddr: testSrcMAC, EtherType: IPv4_PROTOCOL},
+		&IPv4Header{TTL: 64, Protocol: ICMP_PROTOCOL, SourceIp: [4]byte{192, 0, 2, 2}, DestIp: [4]byte{192, 0, 2, 1}},
+		&ICMPPacket{Type: 8, Id: 1, Seq: 2},
+	}
+	opts := SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := SerializeLayers(buf, opts, layers...); err != nil {
+		t.Fatal(err)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		SerializeLayers(buf, opts, layers...)
+	})
+	if allocs != 0 || len(buf.Bytes()) != 14+minPayloadLen {
+		t.Fatalf("%v allocations for a %d byte frame in a cleared buffer", allocs, len(buf.Bytes()))
+	}
+
+	err := SerializeLayers(buf, SerializeOptions{}, &EthernetHeader{}, &VLANTag{})
+	if !errors.Is(err, ErrNotSerializable) {
+		t.Fatalf("error %v, want %v", err, ErrNotSerializable)
+	}
+}
@@ -0,0 +1,58 @@
+package netlibk
+
+import "sync/atomic"
+
+// what happened to the frames the client received, together with the kernel counters of its socket
+// the kernel drops tell the replies were lost on our side, the rejected, malformed and truncated that they came but were not used
+type ClientStats struct {
+	// zero when the connection is not a RawConn
+	SocketStats
+
+	Parsed    uint64 // frames the client was waiting for and decoded
+	Rejected  uint64 // frames skipped because they were not of the wanted type
+	Malformed uint64 // frames that could not be decoded
+	Truncated uint64 // frames skipped because they did not fit into the read buffer (see WithFrameSize)
+}
+
+// a connection that has the kernel counters, RawConn is one
+type StatsConn interface {
+	Stats() (SocketStats, error)
+}
+
+// the counters of the received frames, updated by the receive functions
+type frameCounters struct {
+	parsed    atomic.Uint64
+	rejected  atomic.Uint64
+	malformed atomic.Uint64
+	truncated atomic.Uint64
+}
+
+// the counters of the client and the kernel counters of its socket
+func (c *Client) Stats() (ClientStats, error) {
+	st := ClientStats{
+		Parsed:    c.counters.parsed.Load(),
+		Rejected:  c.counters.rejected.Load(),
+		Malformed: c.counters.malformed.Load(),
+		Truncated: c.counters.truncated.Load(),
+	}
+
+	if sc, ok := c.Conn.(StatsConn); ok {
+		ss, err := sc.Stats()
+		if err != nil {
+			return st, err
+		}
+		st.SocketStats = ss
+	}
+
+	return st, nil
+}
+
+// count and log the frame that did not fit into the read buffer, it can not be decoded whole so it is skipped
+func (c *Client) skipTruncated(n int, info FrameInfo) bool {
+	if !info.Truncated {
+		return false
+	}
+	c.counters.truncated.Add(1)
+	c.logger().Debug("skipping truncated frame", "len", info.Length, "read", n)
+	return true
+}
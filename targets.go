@@ -0,0 +1,401 @@
+package netlibk
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"net/netip"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// the target specification could not be parsed
+var ErrInvalidTarget = errors.New("Error invalid target specification")
+
+// a set of scan targets parsed from nmap style specifications like
+// "10.0.0.1-50", "10.0.0-3,5.*", "10.0.0.0/24", "example.com", "10.0.0.1,5,7" or "@targets.txt"
+// the addresses are generated lazily when iterating, so big ranges are never materialized
+type TargetSet struct {
+	include []targetSpec
+	exclude []targetSpec
+}
+
+// one parsed target, so a prefix, an octet range or a list of single addresses
+type targetSpec interface {
+	contains(a netip.Addr) bool
+	addrs() iter.Seq[netip.Addr]
+}
+
+// parse the target specifications into a new set, the context limits the lookups of the hostnames
+func ParseTargets(ctx context.Context, specs ...string) (*TargetSet, error) {
+	ts := new(TargetSet)
+	if err := ts.Add(ctx, specs...); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+// add more targets to the set
+func (ts *TargetSet) Add(ctx context.Context, specs ...string) error {
+	parsed, err := parseTargetSpecs(ctx, specs)
+	if err != nil {
+		return err
+	}
+	ts.include = append(ts.include, parsed...)
+	return nil
+}
+
+// leave the addresses matched by the specifications out of the set (like nmap --exclude)
+func (ts *TargetSet) Exclude(ctx context.Context, specs ...string) error {
+	parsed, err := parseTargetSpecs(ctx, specs)
+	if err != nil {
+		return err
+	}
+	ts.exclude = append(ts.exclude, parsed...)
+	return nil
+}
+
+// check whether the address is one of the targets
+func (ts *TargetSet) Contains(a netip.Addr) bool {
+	a = a.Unmap()
+	if ts.excluded(a) {
+		return false
+	}
+	for _, spec := range ts.include {
+		if spec.contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func (ts *TargetSet) excluded(a netip.Addr) bool {
+	for _, spec := range ts.exclude {
+		if spec.contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// lazily go through every target address once, in the order the specifications were given
+// an address that is matched by more specifications is yielded only for the first one of them
+func (ts *TargetSet) All() iter.Seq[netip.Addr] {
+	return func(yield func(netip.Addr) bool) {
+		for i, spec := range ts.include {
+			for a := range spec.addrs() {
+				if ts.excluded(a) || ts.seenBefore(i, a) {
+					continue
+				}
+				if !yield(a) {
+					return
+				}
+			}
+		}
+	}
+}
+
+// whether one of the specifications before the i-th already yielded the address
+func (ts *TargetSet) seenBefore(i int, a netip.Addr) bool {
+	for _, spec := range ts.include[:i] {
+		if spec.contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseTargetSpecs(ctx context.Context, specs []string) ([]targetSpec, error) {
+	var parsed []targetSpec
+	for _, s := range specs {
+		for _, field := range strings.Fields(s) {
+			p, err := parseTargetField(ctx, field, parsed)
+			if err != nil {
+				return nil, err
+			}
+			parsed = p
+		}
+	}
+	return parsed, nil
+}
+
+// parse one whitespace separated field, appending to the parsed specs
+// an IPv4 octet spec has its commas in the octets like in nmap ("10.0.0-3,5.1"),
+// any other field can be a comma list of targets
+func parseTargetField(ctx context.Context, field string, parsed []targetSpec) ([]targetSpec, error) {
+	if strings.HasPrefix(field, "@") {
+		return parseTargetFile(ctx, field[1:], parsed)
+	}
+
+	if looksLikeOctets(field) {
+		spec, err := parseOctetSpec(field)
+		if err != nil {
+			return nil, err
+		}
+		return append(parsed, spec), nil
+	}
+
+	var last *octetSpec
+	for _, item := range strings.Split(field, ",") {
+		if item == "" {
+			continue
+		}
+
+		// a bare number or number range after an address in the list continues its last octet,
+		// so "example.com,10.0.0.1,5,7-9" has the 10.0.0.1, 5 and 7-9
+		if isOctetItem(item) {
+			if last == nil {
+				return nil, &AddrError{Addr: item, Err: ErrInvalidTarget}
+			}
+			r, err := parseOctetRange(item)
+			if err != nil {
+				return nil, &AddrError{Addr: item, Err: ErrInvalidTarget}
+			}
+			last.octets[3] = append(last.octets[3], r)
+			continue
+		}
+
+		spec, err := parseTarget(ctx, item)
+		if err != nil {
+			return nil, err
+		}
+		last, _ = spec.(*octetSpec)
+		parsed = append(parsed, spec)
+	}
+
+	return parsed, nil
+}
+
+// read the targets from the file, one or more per line, with # starting a comment
+func parseTargetFile(ctx context.Context, path string, parsed []targetSpec) ([]targetSpec, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening the targets file: %v", err)
+	}
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		for _, field := range strings.Fields(line) {
+			// no nested files
+			if strings.HasPrefix(field, "@") {
+				return nil, &AddrError{Addr: field, Err: ErrInvalidTarget}
+			}
+			if parsed, err = parseTargetField(ctx, field, parsed); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading the targets file: %v", err)
+	}
+
+	return parsed, nil
+}
+
+// parse a single target (no commas)
+func parseTarget(ctx context.Context, s string) (targetSpec, error) {
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return nil, &AddrError{Addr: s, Err: ErrInvalidCIDR}
+		}
+		return &prefixSpec{prefix: p.Masked()}, nil
+	}
+
+	// a plain IPv4 address is an octet spec too, so a following ",5,7" can extend it
+	if looksLikeOctets(s) {
+		return parseOctetSpec(s)
+	}
+
+	if a, err := netip.ParseAddr(s); err == nil {
+		return newListSpec([]netip.Addr{a}), nil
+	}
+
+	// anything else has to be a hostname
+	res := ResolveTargets(ctx, []string{s}, &ResolveOptions{IPv6: true})
+	if res[0].Err != nil || len(res[0].Addrs) == 0 {
+		return nil, &AddrError{Addr: s, Err: fmt.Errorf("Error resolving the hostname: %v", res[0].Err)}
+	}
+	return newListSpec(res[0].Addrs), nil
+}
+
+// the whole spec is made of digits, dots, dashes, commas and stars
+func looksLikeOctets(s string) bool {
+	return strings.Count(s, ".") == 3 && strings.Trim(s, "0123456789.-*,") == ""
+}
+
+func isOctetItem(s string) bool {
+	return strings.Trim(s, "0123456789-") == ""
+}
+
+// the list of single addresses, for literal ips and resolved hostnames
+type listSpec struct {
+	list []netip.Addr
+}
+
+func newListSpec(addrs []netip.Addr) *listSpec {
+	ls := &listSpec{}
+	for _, a := range addrs {
+		a = a.Unmap().WithZone("")
+		if !ls.contains(a) {
+			ls.list = append(ls.list, a)
+		}
+	}
+	return ls
+}
+
+func (ls *listSpec) contains(a netip.Addr) bool {
+	for _, l := range ls.list {
+		if l == a {
+			return true
+		}
+	}
+	return false
+}
+
+func (ls *listSpec) addrs() iter.Seq[netip.Addr] {
+	return func(yield func(netip.Addr) bool) {
+		for _, a := range ls.list {
+			if !yield(a) {
+				return
+			}
+		}
+	}
+}
+
+type prefixSpec struct {
+	prefix netip.Prefix
+}
+
+func (ps *prefixSpec) contains(a netip.Addr) bool {
+	return ps.prefix.Contains(a)
+}
+
+func (ps *prefixSpec) addrs() iter.Seq[netip.Addr] {
+	seq, err := PrefixAddrs(ps.prefix)
+	if err != nil {
+		// too large to go through (like a /64), so there is nothing to yield
+		logger().Warn("skipping target prefix", "prefix", ps.prefix, "err", err)
+		return func(func(netip.Addr) bool) {}
+	}
+	return seq
+}
+
+// an IPv4 spec with a list of ranges for every octet, "*" is the whole 0-255
+type octetSpec struct {
+	octets [4][]octetRange
+}
+
+type octetRange struct {
+	lo, hi uint8
+}
+
+func parseOctetSpec(s string) (*octetSpec, error) {
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return nil, &AddrError{Addr: s, Err: ErrInvalidTarget}
+	}
+
+	oc := new(octetSpec)
+	for i, part := range parts {
+		// every octet is a comma list of ranges
+		for _, item := range strings.Split(part, ",") {
+			r, err := parseOctetRange(item)
+			if err != nil {
+				return nil, &AddrError{Addr: s, Err: ErrInvalidTarget}
+			}
+			oc.octets[i] = append(oc.octets[i], r)
+		}
+	}
+	return oc, nil
+}
+
+// parse "*", "5", "1-50", "-50" or "200-"
+func parseOctetRange(s string) (octetRange, error) {
+	switch s {
+	case "":
+		return octetRange{}, ErrInvalidRange
+	case "*":
+		return octetRange{0, 255}, nil
+	}
+
+	loS, hiS, isRange := strings.Cut(s, "-")
+	if !isRange {
+		hiS = loS
+	}
+	if loS == "" {
+		loS = "0"
+	}
+	if hiS == "" {
+		hiS = "255"
+	}
+
+	lo, err := strconv.ParseUint(loS, 10, 8)
+	if err != nil {
+		return octetRange{}, err
+	}
+	hi, err := strconv.ParseUint(hiS, 10, 8)
+	if err != nil {
+		return octetRange{}, err
+	}
+	if lo > hi {
+		return octetRange{}, ErrInvalidRange
+	}
+
+	return octetRange{uint8(lo), uint8(hi)}, nil
+}
+
+func (oc *octetSpec) contains(a netip.Addr) bool {
+	if !a.Is4() {
+		return false
+	}
+	b := a.As4()
+	for i, ranges := range oc.octets {
+		if !inOctetRanges(ranges, b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func inOctetRanges(ranges []octetRange, v uint8) bool {
+	for _, r := range ranges {
+		if v >= r.lo && v <= r.hi {
+			return true
+		}
+	}
+	return false
+}
+
+func (oc *octetSpec) addrs() iter.Seq[netip.Addr] {
+	return func(yield func(netip.Addr) bool) {
+		var b [4]byte
+		oc.walk(0, &b, yield)
+	}
+}
+
+// go through the octets from the first one, the ranges of an octet can overlap so check that
+// the value was not already covered by an earlier range of the same octet
+func (oc *octetSpec) walk(i int, b *[4]byte, yield func(netip.Addr) bool) bool {
+	if i == 4 {
+		return yield(netip.AddrFrom4(*b))
+	}
+
+	for j, r := range oc.octets[i] {
+		for v := int(r.lo); v <= int(r.hi); v++ {
+			if inOctetRanges(oc.octets[i][:j], uint8(v)) {
+				continue
+			}
+			b[i] = uint8(v)
+			if !oc.walk(i+1, b, yield) {
+				return false
+			}
+		}
+	}
+	return true
+}
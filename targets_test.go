@@ -0,0 +1,146 @@
+package netlibk
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func parseAddrs(t *testing.T, ss ...string) []netip.Addr {
+	t.Helper()
+	addrs := make([]netip.Addr, len(ss))
+	for i, s := range ss {
+		addrs[i] = netip.MustParseAddr(s)
+	}
+	return addrs
+}
+
+func TestParseTargets(t *testing.T) {
+	tests := []struct {
+		specs []string
+		want  []string
+	}{
+		{[]string{"10.0.0.1"}, []string{"10.0.0.1"}},
+		{[]string{"10.0.0.1-3"}, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}},
+		{[]string{"10.0.0.254-"}, []string{"10.0.0.254", "10.0.0.255"}},
+		{[]string{"10.0.0.-1"}, []string{"10.0.0.0", "10.0.0.1"}},
+		{[]string{"10.0.0-1.7"}, []string{"10.0.0.7", "10.0.1.7"}},
+		{[]string{"10.0.0.1,5,7-9"}, []string{"10.0.0.1", "10.0.0.5", "10.0.0.7", "10.0.0.8", "10.0.0.9"}},
+		{[]string{"10.0.0.1,3-4,2-4"}, []string{"10.0.0.1", "10.0.0.3", "10.0.0.4", "10.0.0.2"}},
+		{[]string{"10.0.0.1,10.0.1.1,2"}, []string{"10.0.0.1", "10.0.1.1", "10.0.1.2"}},
+		{[]string{"192.0.2.5/30"}, []string{"192.0.2.4", "192.0.2.5", "192.0.2.6", "192.0.2.7"}},
+		{[]string{"2001:db8::1", "2001:db8::/127"}, []string{"2001:db8::1", "2001:db8::"}},
+		{[]string{"::ffff:10.0.0.1"}, []string{"10.0.0.1"}},
+		// the same address from more specifications is there only once
+		{[]string{"10.0.0.2 10.0.0.1-3", "10.0.0.0/30"}, []string{"10.0.0.2", "10.0.0.1", "10.0.0.3", "10.0.0.0"}},
+		{[]string{",10.0.0.1,10.0.0.2,"}, []string{"10.0.0.1", "10.0.0.2"}},
+		{[]string{"2001:db8::1,,2001:db8::2"}, []string{"2001:db8::1", "2001:db8::2"}},
+		// the commas inside the octets list the values of that octet
+		{[]string{"10.0.0-1,5.7"}, []string{"10.0.0.7", "10.0.1.7", "10.0.5.7"}},
+		{[]string{"10.0,1.0.1,2"}, []string{"10.0.0.1", "10.0.0.2", "10.1.0.1", "10.1.0.2"}},
+		{[]string{"10,11.0.0.-1"}, []string{"10.0.0.0", "10.0.0.1", "11.0.0.0", "11.0.0.1"}},
+	}
+
+	for _, tt := range tests {
+		ts, err := ParseTargets(context.Background(), tt.specs...)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.specs, err)
+		}
+		want := parseAddrs(t, tt.want...)
+		if got := slices.Collect(ts.All()); !slices.Equal(got, want) {
+			t.Fatalf("%q: got %v, want %v", tt.specs, got, want)
+		}
+		for _, a := range want {
+			if !ts.Contains(a) {
+				t.Fatalf("%q: does not contain %v", tt.specs, a)
+			}
+		}
+	}
+}
+
+func TestParseTargetsStar(t *testing.T) {
+	ts, err := ParseTargets(context.Background(), "10.0.*.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := slices.Collect(ts.All())
+	if len(got) != 256 || got[0] != netip.MustParseAddr("10.0.0.1") || got[255] != netip.MustParseAddr("10.0.255.1") {
+		t.Fatalf("10.0.*.1 gave %d addresses from %v", len(got), got[0])
+	}
+	if ts.Contains(netip.MustParseAddr("10.0.3.2")) || ts.Contains(netip.MustParseAddr("2001:db8::1")) {
+		t.Fatal("10.0.*.1 contains addresses outside of it")
+	}
+}
+
+func TestParseTargetsInvalid(t *testing.T) {
+	tests := []struct {
+		spec string
+		err  error
+	}{
+		{"10.0.0.256", ErrInvalidTarget},
+		{"10.0.0.5-1", ErrInvalidTarget},
+		{"10.0.0.1-2-3", ErrInvalidTarget},
+		{"5", ErrInvalidTarget},
+		{"10.0.0.0/24,5", ErrInvalidTarget},
+		{"10.0.0.1,300", ErrInvalidTarget},
+		{"10.0.0.", ErrInvalidTarget},
+		{"10.0.,1.1", ErrInvalidTarget},
+		{"10.0.0.1,,2", ErrInvalidTarget},
+		{"10.0.0-1,256.1", ErrInvalidTarget},
+		{"10.0.0.0/33", ErrInvalidCIDR},
+	}
+
+	for _, tt := range tests {
+		if _, err := ParseTargets(context.Background(), tt.spec); !errors.Is(err, tt.err) {
+			t.Fatalf("%q: error %v, want %v", tt.spec, err, tt.err)
+		}
+	}
+}
+
+func TestTargetsExclude(t *testing.T) {
+	ts, err := ParseTargets(context.Background(), "192.0.2.0/29")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ts.Exclude(context.Background(), "192.0.2.0,7", "192.0.2.2-3"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := parseAddrs(t, "192.0.2.1", "192.0.2.4", "192.0.2.5", "192.0.2.6")
+	if got := slices.Collect(ts.All()); !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if ts.Contains(netip.MustParseAddr("192.0.2.7")) {
+		t.Fatal("contains an excluded address")
+	}
+}
+
+func TestTargetsFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "targets.txt")
+	content := "# scan these\n10.0.0.1,2   10.0.1.1\n\n2001:db8::1 # the router\n"
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	ts, err := ParseTargets(context.Background(), "@"+path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := parseAddrs(t, "10.0.0.1", "10.0.0.2", "10.0.1.1", "2001:db8::1")
+	if got := slices.Collect(ts.All()); !slices.Equal(got, want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	nested := filepath.Join(dir, "nested.txt")
+	if err := os.WriteFile(nested, []byte("@"+path+"\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseTargets(context.Background(), "@"+nested); !errors.Is(err, ErrInvalidTarget) {
+		t.Fatalf("nested file: error %v, want %v", err, ErrInvalidTarget)
+	}
+}
@@ -0,0 +1,207 @@
+package netlibk
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// what kind of receive timestamps the socket asks the kernel for
+type timestampMode int
+
+const (
+	timestampNone timestampMode = iota
+	timestampSoftware
+	timestampHardware
+)
+
+// ask the kernel for the time every frame was received (SO_TIMESTAMPNS), returned by RawConn.ReadFrame
+// it is taken when the frame comes to the network stack, so the scheduling of the reader does not count in
+func ListenTimestamps() ListenOption {
+	return func(lc *listenConfig) {
+		if lc.timestamps == timestampNone {
+			lc.timestamps = timestampSoftware
+		}
+	}
+}
+
+// ask for the hardware timestamps of the network card (SO_TIMESTAMPING) too, they are in FrameInfo.HardwareTimestamp
+// and the Timestamp stays the software one, the card stamps by its own clock so the two can not be mixed
+// the card has to have the hardware timestamping turned on (like with hwstamp_ctl), this does not do it
+func ListenHardwareTimestamps() ListenOption {
+	return func(lc *listenConfig) {
+		lc.timestamps = timestampHardware
+	}
+}
+
+// set the timestamp socket options, the rx ring is stamped the same way (PACKET_TIMESTAMP)
+func (m timestampMode) apply(fd int) error {
+	switch m {
+	case timestampSoftware:
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1); err != nil {
+			return fmt.Errorf("Error enabling the receive timestamps: %v", err)
+		}
+	case timestampHardware:
+		flags := unix.SOF_TIMESTAMPING_RX_HARDWARE | unix.SOF_TIMESTAMPING_RAW_HARDWARE |
+			unix.SOF_TIMESTAMPING_RX_SOFTWARE | unix.SOF_TIMESTAMPING_SOFTWARE
+		if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, unix.SO_TIMESTAMPING, flags); err != nil {
+			return fmt.Errorf("Error enabling the hardware timestamps: %v", err)
+		}
+		if err := syscall.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_TIMESTAMP, unix.SOF_TIMESTAMPING_RAW_HARDWARE); err != nil {
+			return fmt.Errorf("Error enabling the hardware timestamps of the ring: %v", err)
+		}
+	}
+	return nil
+}
+
+// space for the control messages of one frame, the aux data and the timestamps
+var oobSpace = syscall.CmsgSpace(int(unsafe.Sizeof(unix.TpacketAuxdata{}))) +
+	syscall.CmsgSpace(3*int(unsafe.Sizeof(unix.Timespec{})))
+
+// the control message buffers of readMsg, so every read does not allocate a new one
+var oobPool = sync.Pool{
+	New: func() any {
+		b := make([]byte, oobSpace)
+		return &b
+	},
+}
+
+// the frames are read with recvmsg when there is something in the control messages we want
+func (rc *RawConn) readsMsg() bool {
+	return rc.auxData || rc.timestamps != timestampNone
+}
+
+// read the frame with recvmsg, put the stripped vlan tag back into the frame and take the kernel timestamp
+func readMsg(fd int, b []byte) (int, syscall.Sockaddr, FrameInfo, error) {
+	op := oobPool.Get().(*[]byte)
+	defer oobPool.Put(op)
+	oob := *op
+
+	n, oobn, _, from, err := syscall.Recvmsg(fd, b, oob, syscall.MSG_TRUNC)
+	if err != nil {
+		return 0, nil, FrameInfo{}, err
+	}
+
+	info := FrameInfo{Length: n}
+	n = readControl(b, min(n, len(b)), oob[:oobn], &info)
+	return n, from, info, nil
+}
+
+// go through the control messages of the n byte frame in b, returns the new frame length
+func readControl(b []byte, n int, oob []byte, info *FrameInfo) int {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return n
+	}
+
+	for _, m := range msgs {
+		switch {
+		case m.Header.Level == unix.SOL_PACKET && m.Header.Type == unix.PACKET_AUXDATA:
+			if len(m.Data) < int(unsafe.Sizeof(unix.TpacketAuxdata{})) {
+				continue
+			}
+			aux := (*unix.TpacketAuxdata)(unsafe.Pointer(&m.Data[0]))
+			info.Length = int(aux.Len)
+			if aux.Status&unix.TP_STATUS_VLAN_VALID == 0 {
+				continue
+			}
+
+			// the kernel stripped the tag (vlan offload), put it back in place so the EthernetHeader sees it
+			tag := VLANTag{TPID: VLAN_PROTOCOL}
+			if aux.Status&unix.TP_STATUS_VLAN_TPID_VALID != 0 {
+				tag.TPID = EtherType(aux.Vlan_tpid)
+			}
+			tag.setTCI(aux.Vlan_tci)
+			n = insertVLANTag(b, n, tag)
+			info.Length += 4
+
+		case m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == unix.SCM_TIMESTAMPNS:
+			if len(m.Data) < int(unsafe.Sizeof(unix.Timespec{})) {
+				continue
+			}
+			ts := (*unix.Timespec)(unsafe.Pointer(&m.Data[0]))
+			info.Timestamp = time.Unix(ts.Unix())
+
+		case m.Header.Level == syscall.SOL_SOCKET && m.Header.Type == unix.SCM_TIMESTAMPING:
+			// three timestamps, the software one, a deprecated one and the raw hardware one
+			if len(m.Data) < 3*int(unsafe.Sizeof(unix.Timespec{})) {
+				continue
+			}
+			ts := (*[3]unix.Timespec)(unsafe.Pointer(&m.Data[0]))
+			if sw := ts[0]; sw.Sec != 0 || sw.Nsec != 0 {
+				info.Timestamp = time.Unix(sw.Unix())
+			}
+			if hw := ts[2]; hw.Sec != 0 || hw.Nsec != 0 {
+				info.HardwareTimestamp = time.Unix(hw.Unix())
+			}
+		}
+	}
+
+	return n
+}
+
+// a connection that can tell when the frame was received, RawConn is one
+type FrameReader interface {
+	ReadFrame(b []byte) (int, FrameInfo, error)
+}
+
+// read a frame with its receive time, the kernel one when the connection can give it
+// a cooked frame gets an ethernet header in front, so it is decoded the same way
+func (c *Client) readFrame(b []byte) (int, FrameInfo, error) {
+	if c.cooked() {
+		return c.readCooked(b)
+	}
+	if fr, ok := c.Conn.(FrameReader); ok {
+		return fr.ReadFrame(b)
+	}
+
+	n, _, err := c.Conn.ReadFrom(b)
+	if err != nil {
+		return 0, FrameInfo{}, err
+	}
+	return n, FrameInfo{Timestamp: time.Now(), Length: n}, nil
+}
+
+// how many echo requests the client remembers the send time of, the replies that never came are forgotten
+// (the oldest first) once there are more
+const maxPendingEchoes = 1024
+
+// remember when the echo request with the sequence number was sent
+func (c *Client) markSent(seq uint16) {
+	c.sentMu.Lock()
+	defer c.sentMu.Unlock()
+
+	if c.sentAt == nil {
+		c.sentAt = make(map[uint16]time.Time)
+	}
+	if _, ok := c.sentAt[seq]; !ok && len(c.sentAt) >= maxPendingEchoes {
+		var oldest uint16
+		var oldestAt time.Time
+		for s, at := range c.sentAt {
+			if oldestAt.IsZero() || at.Before(oldestAt) {
+				oldest, oldestAt = s, at
+			}
+		}
+		delete(c.sentAt, oldest)
+	}
+	c.sentAt[seq] = time.Now()
+}
+
+// the time between sending the echo request with the sequence number and receiving its reply,
+// false when the request was not sent by this client
+// the received time has to be by the system clock (FrameInfo.Timestamp), same as the send time
+func (c *Client) rtt(seq uint16, received time.Time) (time.Duration, bool) {
+	c.sentMu.Lock()
+	defer c.sentMu.Unlock()
+
+	sent, ok := c.sentAt[seq]
+	if !ok {
+		return 0, false
+	}
+	delete(c.sentAt, seq)
+	return received.Sub(sent), true
+}
@@ -0,0 +1,121 @@
+package netlibk
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// ip protocol numbers of the transport protocols
+const (
+	TCP_PROTOCOL uint8 = 6
+	UDP_PROTOCOL uint8 = 17
+)
+
+// the segment is not a valid TCP or UDP segment
+var ErrInvalidSegment = errors.New("Invalid transport segment")
+
+type UDPHeader struct {
+	SourcePort uint16 // 2 bytes
+	DestPort   uint16 // 2 bytes
+	Length     uint16 // 2 bytes, header + payload
+	Checksum   uint16 // 2 bytes
+}
+
+// TCP flags, the lowest 9 bits of the Flags field
+const (
+	TCPFlagFIN uint16 = 1 << iota
+	TCPFlagSYN
+	TCPFlagRST
+	TCPFlagPSH
+	TCPFlagACK
+	TCPFlagURG
+	TCPFlagECE
+	TCPFlagCWR
+	TCPFlagNS
+)
+
+type TCPHeader struct {
+	SourcePort uint16 // 2 bytes
+	DestPort   uint16 // 2 bytes
+	Seq        uint32 // 4 bytes
+	Ack        uint32 // 4 bytes
+	DataOffset uint8  // 4 bits, header length in 32 bit words
+	Flags      uint16 // 9 bits
+	Window     uint16 // 2 bytes
+	Checksum   uint16 // 2 bytes
+	Urgent     uint16 // 2 bytes
+	Options    []byte // (DataOffset - 5) * 4 bytes
+}
+
+// the header has no slices, so this is the same as DecodeFromBytes
+func (u *UDPHeader) Unmarshal(b []byte) error {
+	return u.DecodeFromBytes(b)
+}
+
+func (u *UDPHeader) DecodeFromBytes(b []byte) error {
+	if len(b) < 8 {
+		return io.ErrUnexpectedEOF
+	}
+
+	u.SourcePort = binary.BigEndian.Uint16(b[0:2])
+	u.DestPort = binary.BigEndian.Uint16(b[2:4])
+	u.Length = binary.BigEndian.Uint16(b[4:6])
+	u.Checksum = binary.BigEndian.Uint16(b[6:8])
+
+	if u.Length < 8 {
+		return ErrInvalidSegment
+	}
+	if len(b) < int(u.Length) {
+		return io.ErrUnexpectedEOF
+	}
+
+	return nil
+}
+
+// the options are copied, so the header does not point into b
+func (t *TCPHeader) Unmarshal(b []byte) error {
+	if err := t.DecodeFromBytes(b); err != nil {
+		return err
+	}
+
+	if len(t.Options) > 0 {
+		t.Options = append([]byte(nil), t.Options...)
+	} else {
+		t.Options = nil
+	}
+	return nil
+}
+
+// decode the header without copying, the options point into b
+func (t *TCPHeader) DecodeFromBytes(b []byte) error {
+	if len(b) < 20 {
+		return io.ErrUnexpectedEOF
+	}
+
+	t.SourcePort = binary.BigEndian.Uint16(b[0:2])
+	t.DestPort = binary.BigEndian.Uint16(b[2:4])
+	t.Seq = binary.BigEndian.Uint32(b[4:8])
+	t.Ack = binary.BigEndian.Uint32(b[8:12])
+
+	// 4 bits data offset, 3 bits reserved, 9 bits flags
+	off := binary.BigEndian.Uint16(b[12:14])
+	t.DataOffset = uint8(off >> 12)
+	t.Flags = off & 0x01ff
+
+	t.Window = binary.BigEndian.Uint16(b[14:16])
+	t.Checksum = binary.BigEndian.Uint16(b[16:18])
+	t.Urgent = binary.BigEndian.Uint16(b[18:20])
+
+	hlen := int(t.DataOffset) * 4
+	if hlen < 20 {
+		return ErrInvalidSegment
+	}
+	if len(b) < hlen {
+		return io.ErrUnexpectedEOF
+	}
+
+	t.Options = b[20:hlen]
+
+	return nil
+}
@@ -0,0 +1,304 @@
+package netlibk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// the kind of the virtual device
+type TunType int
+
+const (
+	// the device gives and takes IPv4 and IPv6 packets, with no link layer header
+	TunDevice TunType = iota
+	// the device gives and takes whole ethernet frames
+	TapDevice
+)
+
+// a net.PacketConn on a TUN or TAP device (/dev/net/tun), so the client can run against a virtual interface
+// we are the other end of the link, what is written here is received by the kernel on the interface
+// and what the kernel sends out of the interface is read here
+// the client on a TAP device gets the ethernet frames, so arp works there, on a TUN device it gets
+// the ip packets only (like the cooked RawConn), so there the client pings without arp
+type TunConn struct {
+	f    *os.File
+	name string
+	typ  TunType
+	// the hardware address of the device, nil for TUN
+	hwAddr net.HardwareAddr
+}
+
+var _ net.PacketConn = &TunConn{}
+
+var ErrInvalidTunType = errors.New("Error invalid tun device type")
+
+type tunConfig struct {
+	prefix netip.Prefix
+	up     bool
+}
+
+type TunOption func(*tunConfig)
+
+// give the interface (so the kernel end of the link) the IPv4 address with its subnet
+func TunAddress(p netip.Prefix) TunOption {
+	return func(cfg *tunConfig) {
+		cfg.prefix = p
+	}
+}
+
+// bring the interface up, the kernel does not send or take anything on it before that
+func TunUp() TunOption {
+	return func(cfg *tunConfig) {
+		cfg.up = true
+	}
+}
+
+// create the TUN or TAP device with the name, or attach to it when it already exists (and is persistent)
+// with an empty name the kernel picks one like tun0 or tap0, see Name
+// the device is removed on Close unless it was made persistent before (ip tuntap add)
+func ListenTun(name string, typ TunType, opts ...TunOption) (*TunConn, error) {
+	cfg := new(tunConfig)
+	for _, opt := range opts {
+		opt(cfg)
+	}
+
+	var flags uint16 = unix.IFF_NO_PI
+	switch typ {
+	case TunDevice:
+		flags |= unix.IFF_TUN
+	case TapDevice:
+		flags |= unix.IFF_TAP
+	default:
+		return nil, ErrInvalidTunType
+	}
+
+	// non blocking, so the os.File reads go through the poller and the deadlines work
+	fd, err := unix.Open("/dev/net/tun", unix.O_RDWR|unix.O_NONBLOCK|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("Error opening /dev/net/tun: %v", err)
+	}
+
+	ifr, err := unix.NewIfreq(name)
+	if err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("Error invalid tun device name %q: %v", name, err)
+	}
+	ifr.SetUint16(flags)
+	if err := unix.IoctlIfreq(fd, unix.TUNSETIFF, ifr); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("Error creating the tun device %q: %v", name, err)
+	}
+
+	t := &TunConn{
+		f:    os.NewFile(uintptr(fd), "/dev/net/tun"),
+		name: ifr.Name(),
+		typ:  typ,
+	}
+
+	if err := t.configure(cfg); err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	ifi, err := t.Interface()
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	t.hwAddr = ifi.HardwareAddr
+
+	return t, nil
+}
+
+// the addresses of the client on the far end of the tun device, its ip with the subnet of the device address
+// on the same subnet, or alone when there is none
+func tunClientAddrs(addrs []net.Addr, ip net.IP) []net.Addr {
+	if ip == nil {
+		return nil
+	}
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.Contains(ip) {
+			return []net.Addr{&net.IPNet{IP: ip, Mask: n.Mask}}
+		}
+	}
+	bits := 8 * net.IPv6len
+	if ip.To4() != nil {
+		bits = 8 * net.IPv4len
+	}
+	return []net.Addr{&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}}
+}
+
+// a random unicast mac with the locally administered bit set, so it is not the one of a real card
+func randomLocalMAC() net.HardwareAddr {
+	mac := make(net.HardwareAddr, 6)
+	for i := range mac {
+		mac[i] = byte(rand.Uint32())
+	}
+	mac[0] = mac[0]&^0x01 | 0x02
+	return mac
+}
+
+// set the address and the flags of the interface, that is done with ioctls on any inet socket
+func (t *TunConn) configure(cfg *tunConfig) error {
+	if !cfg.prefix.IsValid() && !cfg.up {
+		return nil
+	}
+
+	s, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return fmt.Errorf("Error opening the socket to configure %s: %v", t.name, err)
+	}
+	defer unix.Close(s)
+
+	if cfg.prefix.IsValid() {
+		if !cfg.prefix.Addr().Is4() {
+			return ErrInvalidIP
+		}
+		if err := t.setInet4(s, unix.SIOCSIFADDR, cfg.prefix.Addr().As4()); err != nil {
+			return fmt.Errorf("Error setting the address of %s: %v", t.name, err)
+		}
+
+		var mask [4]byte
+		binary.BigEndian.PutUint32(mask[:], ^uint32(0)<<(32-cfg.prefix.Bits()))
+		if err := t.setInet4(s, unix.SIOCSIFNETMASK, mask); err != nil {
+			return fmt.Errorf("Error setting the netmask of %s: %v", t.name, err)
+		}
+	}
+
+	if cfg.up {
+		ifr, err := unix.NewIfreq(t.name)
+		if err != nil {
+			return err
+		}
+		if err := unix.IoctlIfreq(s, unix.SIOCGIFFLAGS, ifr); err != nil {
+			return fmt.Errorf("Error getting the flags of %s: %v", t.name, err)
+		}
+		ifr.SetUint16(ifr.Uint16() | unix.IFF_UP | unix.IFF_RUNNING)
+		if err := unix.IoctlIfreq(s, unix.SIOCSIFFLAGS, ifr); err != nil {
+			return fmt.Errorf("Error bringing %s up: %v", t.name, err)
+		}
+	}
+
+	return nil
+}
+
+func (t *TunConn) setInet4(s int, req uint, addr [4]byte) error {
+	ifr, err := unix.NewIfreq(t.name)
+	if err != nil {
+		return err
+	}
+	if err := ifr.SetInet4Addr(addr[:]); err != nil {
+		return err
+	}
+	return unix.IoctlIfreq(s, req, ifr)
+}
+
+// the name of the interface, the one the kernel picked when ListenTun got an empty name
+func (t *TunConn) Name() string {
+	return t.name
+}
+
+// the network interface of the device, to make the client with
+func (t *TunConn) Interface() (*net.Interface, error) {
+	ifi, err := net.InterfaceByName(t.name)
+	if err != nil {
+		return nil, fmt.Errorf("Error getting the interface %s: %v", t.name, err)
+	}
+	return ifi, nil
+}
+
+// the packets of a TUN device have no link layer header
+func (t *TunConn) Cooked() bool {
+	return t.typ == TunDevice
+}
+
+// read the next frame (TAP) or ip packet (TUN) the kernel sent out of the interface
+// the address is an *Address with the source mac and ether type of the frame,
+// for TUN it has only the ether type, taken from the ip version
+func (t *TunConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	n, err := t.f.Read(b)
+	if err != nil {
+		return 0, nil, err
+	}
+	return n, t.sender(b[:n]), nil
+}
+
+func (t *TunConn) sender(b []byte) *Address {
+	adr := &Address{PacketType: PacketHost}
+
+	if t.typ == TunDevice {
+		if len(b) > 0 {
+			switch b[0] >> 4 {
+			case 4:
+				adr.Protocol = IPv4_PROTOCOL
+			case 6:
+				adr.Protocol = IPv6_PROTOCOL
+			}
+		}
+		return adr
+	}
+
+	if len(b) < 14 {
+		return adr
+	}
+	dest := net.HardwareAddr(b[0:6])
+	switch {
+	case bytes.Equal(dest, EthernetBroadcast):
+		adr.PacketType = PacketBroadcast
+	case dest[0]&1 != 0:
+		adr.PacketType = PacketMulticast
+	}
+	adr.HardwareAddr = append(net.HardwareAddr(nil), b[6:12]...)
+	adr.Protocol = EtherType(binary.BigEndian.Uint16(b[12:14]))
+	return adr
+}
+
+// write the frame (TAP) or the ip packet (TUN) into the interface, the kernel receives it as if it came from the link
+// the frame carries its own destination, so the address is not used, but a TUN device takes only ip packets
+// and only a TUN device can be written to an ip address (*net.IPAddr), a TAP device needs the whole frame
+func (t *TunConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	switch a := addr.(type) {
+	case *Address:
+		if t.typ == TunDevice && a.Protocol != 0 && a.Protocol != IPv4_PROTOCOL && a.Protocol != IPv6_PROTOCOL {
+			return 0, ErrInvalidAddr
+		}
+	case *net.IPAddr:
+		if t.typ != TunDevice {
+			return 0, ErrInvalidAddr
+		}
+	case nil:
+	default:
+		return 0, ErrInvalidAddr
+	}
+
+	return t.f.Write(b)
+}
+
+func (t *TunConn) Close() error {
+	return t.f.Close()
+}
+
+func (t *TunConn) LocalAddr() net.Addr {
+	return &Address{HardwareAddr: t.hwAddr}
+}
+
+func (t *TunConn) SetDeadline(d time.Time) error {
+	return t.f.SetDeadline(d)
+}
+
+func (t *TunConn) SetReadDeadline(d time.Time) error {
+	return t.f.SetReadDeadline(d)
+}
+
+func (t *TunConn) SetWriteDeadline(d time.Time) error {
+	return t.f.SetWriteDeadline(d)
+}
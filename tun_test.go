@@ -0,0 +1,97 @@
+package netlibk
+
+import (
+	"bytes"
+	"net"
+	"net/netip"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// make a TUN or TAP device with the kernel end at the address, creating it needs CAP_NET_ADMIN
+// so the test is skipped without it
+func listenTestTun(t *testing.T, typ TunType, kernel netip.Prefix) (*TunConn, *net.Interface) {
+	t.Helper()
+
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var caps [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &caps[0]); err != nil || caps[0].Effective&(1<<unix.CAP_NET_ADMIN) == 0 {
+		t.Skip("tun devices need CAP_NET_ADMIN")
+	}
+	if _, err := os.Stat("/dev/net/tun"); err != nil {
+		t.Skipf("no tun driver: %v", err)
+	}
+
+	tun, err := ListenTun("", typ, TunAddress(kernel), TunUp())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ifi, err := tun.Interface()
+	if err != nil {
+		tun.Close()
+		t.Fatal(err)
+	}
+	return tun, ifi
+}
+
+func newTunClient(t *testing.T, tun *TunConn, ifi *net.Interface, ip netip.Addr, opts ...Option) *Client {
+	t.Helper()
+
+	opts = append(opts, WithConn(tun), WithSourceIP(ip.AsSlice()), WithTimeout(time.Second), WithRetries(2))
+	c, err := NewClient(ifi, opts...)
+	if err != nil {
+		tun.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestTapResolveMAC(t *testing.T) {
+	kernel := netip.MustParsePrefix("198.51.100.1/24")
+	tun, ifi := listenTestTun(t, TapDevice, kernel)
+	c := newTunClient(t, tun, ifi, netip.MustParseAddr("198.51.100.2"))
+
+	// the client is the other end of the link, it must not answer for the kernel's mac
+	if bytes.Equal(c.SourceHardwareAddr, ifi.HardwareAddr) || c.SourceHardwareAddr[0]&0x03 != 0x02 {
+		t.Fatalf("source mac %v is not a local unicast one apart from the device %v", c.SourceHardwareAddr, ifi.HardwareAddr)
+	}
+	if want := netip.MustParsePrefix("198.51.100.2/24"); len(c.Prefixes) != 1 || c.Prefixes[0] != want {
+		t.Fatalf("prefixes %v, want %v", c.Prefixes, want)
+	}
+
+	mac, err := c.ResolveMACAddr(kernel.Addr(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(mac, ifi.HardwareAddr) {
+		t.Fatalf("resolved %v, want the device mac %v", mac, ifi.HardwareAddr)
+	}
+}
+
+func TestTapPing(t *testing.T) {
+	kernel := netip.MustParsePrefix("198.51.100.1/24")
+	tun, ifi := listenTestTun(t, TapDevice, kernel)
+	c := newTunClient(t, tun, ifi, netip.MustParseAddr("198.51.100.2"), WithProtocol(IPv4_PROTOCOL))
+
+	// the arp for the kernel end goes through the same device before the echo
+	if _, active, err := c.PingAddr(kernel.Addr(), []byte("tap ping")); err != nil || !active {
+		t.Fatalf("ping over tap: active %v, err %v", active, err)
+	}
+}
+
+func TestTunPing(t *testing.T) {
+	kernel := netip.MustParsePrefix("203.0.113.1/24")
+	tun, ifi := listenTestTun(t, TunDevice, kernel)
+	c := newTunClient(t, tun, ifi, netip.MustParseAddr("203.0.113.2"), WithProtocol(IPv4_PROTOCOL))
+
+	if !c.cooked() || len(c.SourceHardwareAddr) != 0 {
+		t.Fatalf("tun client should be cooked without a mac, got %v", c.SourceHardwareAddr)
+	}
+	if _, active, err := c.PingAddr(kernel.Addr(), []byte("tun ping")); err != nil || !active {
+		t.Fatalf("ping over tun: active %v, err %v", active, err)
+	}
+}
@@ -0,0 +1,196 @@
+package netlibk
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+var (
+	// the TxFrame was already committed
+	ErrTxFrameCommitted = errors.New("Error tx frame already committed")
+	// every slot of the tx ring is taken by a frame that was not committed yet
+	ErrTxRingBusy = errors.New("Error all the tx ring slots are taken by uncommitted frames")
+	// the frame does not fit into a slot of the tx ring
+	ErrFrameTooLarge = errors.New("Error frame too large for the tx ring slot")
+	// the connection was not made with ListenTxRing
+	ErrNoTxRing = errors.New("Error connection has no tx ring")
+	// the frames of a cooked socket get their link layer header from the sendto address, the ring slots have none
+	ErrCookedTxRing = errors.New("Error the tx ring needs a raw socket")
+)
+
+// send the frames through a memory mapped TPACKET_V3 ring, they are put into the shared memory
+// and the kernel sends all the queued ones with one syscall on Flush
+// WriteTo and WriteBatch go through the ring too
+func ListenTxRing(cfg RingConfig) ListenOption {
+	return func(lc *listenConfig) {
+		lc.txRing = &cfg
+	}
+}
+
+// send the frames straight to the driver without the traffic control (qdisc) layer,
+// faster but the frames are dropped when the driver queue is full
+func ListenQdiscBypass() ListenOption {
+	return func(lc *listenConfig) {
+		lc.qdiscBypass = true
+	}
+}
+
+type txRing struct {
+	mu sync.Mutex
+
+	mem            []byte
+	blockSize      int
+	frameSize      int
+	framesPerBlock int
+	frameCount     int
+
+	// the next slot to give out and how many were committed since the last flush
+	next    int
+	pending int
+	// the slots given out by NextTxFrame and not committed yet
+	taken []bool
+}
+
+// the header of the slot, the status is shared with the kernel so it is only touched atomically
+func (r *txRing) slot(i int) (*unix.Tpacket3Hdr, []byte) {
+	off := i/r.framesPerBlock*r.blockSize + i%r.framesPerBlock*r.frameSize
+	hdr := (*unix.Tpacket3Hdr)(unsafe.Pointer(&r.mem[off]))
+	return hdr, r.mem[off+tpacketHdrLen : off+r.frameSize]
+}
+
+// a slot of the tx ring given out by NextTxFrame, only its owner writes into it
+// it keeps the ring memory mapped until it is committed, even when the conn is closed in the meantime
+type TxFrame struct {
+	rc   *RawConn
+	slot int
+	hdr  *unix.Tpacket3Hdr
+	buf  []byte
+}
+
+// the slot to build the frame in (for example with EthernetHeader.MarshalTo), nil after Commit
+func (f *TxFrame) Buffer() []byte {
+	return f.buf
+}
+
+// queue the n bytes long frame written into the buffer, it is sent on the next Flush
+func (f *TxFrame) Commit(n int) error {
+	if f.hdr == nil {
+		return ErrTxFrameCommitted
+	}
+	if n > len(f.buf) {
+		return ErrFrameTooLarge
+	}
+
+	tx := f.rc.tx
+	tx.mu.Lock()
+	f.hdr.Len = uint32(n)
+	f.hdr.Snaplen = uint32(n)
+	f.hdr.Next_offset = 0
+	atomic.StoreUint32(&f.hdr.Status, unix.TP_STATUS_SEND_REQUEST)
+	tx.taken[f.slot] = false
+	tx.pending++
+	tx.mu.Unlock()
+
+	f.hdr, f.buf = nil, nil
+	return f.rc.releaseRing()
+}
+
+// take the next free slot of the tx ring, every caller gets its own one so more goroutines can fill them at once
+// when the ring is full the queued frames are flushed and it waits (until the write deadline) for a slot
+// the slots are given out and sent by the kernel in the ring order, so a frame that is not committed
+// holds back the frames taken after it, commit every frame taken
+func (rc *RawConn) NextTxFrame() (*TxFrame, error) {
+	if rc.tx == nil {
+		return nil, ErrNoTxRing
+	}
+
+	// the lock is held only while a slot is tried, not while the poller waits for the kernel to give one back,
+	// so the other goroutines can commit and flush their frames meanwhile, the slot is checked again after the wait
+	var f *TxFrame
+	err := rc.write(func(fd int) error {
+		rc.tx.mu.Lock()
+		defer rc.tx.mu.Unlock()
+
+		slot := rc.tx.next
+		if rc.tx.taken[slot] {
+			return ErrTxRingBusy
+		}
+
+		hdr, buf := rc.tx.slot(slot)
+		switch atomic.LoadUint32(&hdr.Status) {
+		case unix.TP_STATUS_AVAILABLE, unix.TP_STATUS_WRONG_FORMAT:
+			// the frame the kernel did not like is skipped, the slot is free again
+			if err := rc.acquireRing(); err != nil {
+				return err
+			}
+			rc.tx.taken[slot] = true
+			rc.tx.next = (slot + 1) % rc.tx.frameCount
+			f = &TxFrame{rc: rc, slot: slot, hdr: hdr, buf: buf}
+			return nil
+		}
+
+		// the kernel still has the slot, so push the queued frames out,
+		// the poller wakes us up when it gives a slot back
+		if rc.tx.pending > 0 {
+			if err := rc.tx.flush(fd, nil); err != nil {
+				return err
+			}
+		}
+		return socketError(fd)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// copy the frame into the next slot of the tx ring and queue it
+func (rc *RawConn) QueueFrame(b []byte) error {
+	if rc.tx == nil {
+		return ErrNoTxRing
+	}
+	// checked before the slot is taken, a taken slot has to be committed
+	if len(b) > rc.tx.frameSize-tpacketHdrLen {
+		return ErrFrameTooLarge
+	}
+
+	f, err := rc.NextTxFrame()
+	if err != nil {
+		return err
+	}
+	return f.Commit(copy(f.Buffer(), b))
+}
+
+// send all the frames queued in the tx ring, they are handed to the kernel
+// and the slots are free again once the driver sent them
+func (rc *RawConn) Flush() error {
+	if rc.tx == nil {
+		return ErrNoTxRing
+	}
+
+	return rc.flush(nil)
+}
+
+// flush with the address for sendto, the kernel takes the protocol and the interface of the queued frames from it
+func (rc *RawConn) flush(sa syscall.Sockaddr) error {
+	// not locked while waiting in the poller, like in NextTxFrame
+	return rc.write(func(fd int) error {
+		rc.tx.mu.Lock()
+		defer rc.tx.mu.Unlock()
+		return rc.tx.flush(fd, sa)
+	})
+}
+
+// tell the kernel to send the queued frames, the tx lock has to be held
+func (r *txRing) flush(fd int, sa syscall.Sockaddr) error {
+	if err := syscall.Sendto(fd, nil, 0, sa); err != nil {
+		return err
+	}
+	r.pending = 0
+	return nil
+}
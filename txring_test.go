@@ -0,0 +1,200 @@
+package netlibk
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// a local experimental ether type, nothing on the loopback takes it
+const testEtherType = 0x88b5
+
+var testTxRing = RingConfig{BlockSize: 1 << 16, BlockCount: 4, FrameSize: 2048}
+
+// listen on the loopback, the packet sockets need CAP_NET_RAW so the test is skipped without it
+func listenLoopback(tb testing.TB, opts ...ListenOption) *RawConn {
+	tb.Helper()
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, 0)
+	if err != nil {
+		tb.Skipf("packet sockets need CAP_NET_RAW: %v", err)
+	}
+	unix.Close(fd)
+
+	ifi, err := net.InterfaceByName("lo")
+	if err != nil {
+		tb.Skipf("no loopback interface: %v", err)
+	}
+	rc, err := Listen(ifi, SockRaw, testEtherType, opts...)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { rc.Close() })
+	return rc
+}
+
+func testFrame() []byte {
+	f := &EthernetHeader{
+		DestAddr:   EthernetBroadcast,
+		SourceAddr: net.HardwareAddr{0x02, 0, 0, 0, 0, 1},
+		EtherType:  testEtherType,
+		Payload:    make([]byte, 46),
+	}
+	b, err := f.Marshal()
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestTxFrameOwnership(t *testing.T) {
+	rc := listenLoopback(t, ListenTxRing(testTxRing))
+	frame := testFrame()
+
+	// every goroutine gets its own slot, a shared one would show up as a frame overwritten by someone else
+	const workers, perWorker = 8, 64
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perWorker; i++ {
+				f, err := rc.NextTxFrame()
+				if err != nil {
+					errs <- err
+					return
+				}
+				b := f.Buffer()
+				n := copy(b, frame)
+				b[n-1] = byte(w)
+				for j := 0; j < 100; j++ {
+					if b[n-1] != byte(w) {
+						errs <- errors.New("tx slot written by another goroutine")
+						return
+					}
+				}
+				if err := f.Commit(n); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+
+	if err := rc.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxFrameCommitTwice(t *testing.T) {
+	rc := listenLoopback(t, ListenTxRing(testTxRing))
+
+	f, err := rc.NextTxFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Commit(len(f.Buffer()) + 1); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("commit too large: got %v, want %v", err, ErrFrameTooLarge)
+	}
+	if err := f.Commit(copy(f.Buffer(), testFrame())); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Commit(60); !errors.Is(err, ErrTxFrameCommitted) {
+		t.Fatalf("second commit: got %v, want %v", err, ErrTxFrameCommitted)
+	}
+}
+
+func TestTxFrameAfterClose(t *testing.T) {
+	rc := listenLoopback(t, ListenTxRing(testTxRing))
+
+	f, err := rc.NextTxFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// the frame keeps the ring mapped, so this does not fault
+	copy(f.Buffer(), testFrame())
+	if err := f.Commit(60); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := rc.NextTxFrame(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("next frame after close: got %v, want %v", err, net.ErrClosed)
+	}
+	if err := rc.Close(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("second close: got %v, want %v", err, net.ErrClosed)
+	}
+}
+
+// the frames before the one that does not fit are still sent and counted
+func TestWriteRingBatchPartial(t *testing.T) {
+	rc := listenLoopback(t, ListenTxRing(testTxRing))
+
+	ms := []Message{{Buffer: testFrame()}, {Buffer: testFrame()}, {Buffer: make([]byte, testTxRing.FrameSize)}, {Buffer: testFrame()}}
+	n, err := rc.WriteBatch(ms)
+	if n != 2 || !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("wrote %d, err %v, want 2 and %v", n, err, ErrFrameTooLarge)
+	}
+	if ms[0].N != len(ms[0].Buffer) || ms[1].N != len(ms[1].Buffer) || ms[2].N != 0 {
+		t.Fatalf("message lengths %d %d %d", ms[0].N, ms[1].N, ms[2].N)
+	}
+
+	rc.tx.mu.Lock()
+	pending := rc.tx.pending
+	rc.tx.mu.Unlock()
+	if pending != 0 {
+		t.Fatalf("%d frames left queued", pending)
+	}
+}
+
+func BenchmarkTxRing(b *testing.B) {
+	rc := listenLoopback(b, ListenTxRing(testTxRing))
+	frame := testFrame()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		f, err := rc.NextTxFrame()
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := f.Commit(copy(f.Buffer(), frame)); err != nil {
+			b.Fatal(err)
+		}
+		// one syscall for a batch of frames, like the scan does
+		if i%scanBatchSize == scanBatchSize-1 {
+			if err := rc.Flush(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+	if err := rc.Flush(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkWriteTo(b *testing.B) {
+	rc := listenLoopback(b)
+	frame := testFrame()
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(frame)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := rc.WriteTo(frame, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
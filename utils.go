@@ -2,9 +2,12 @@ package netlibk
 
 import (
 	"errors"
+	"fmt"
 	"net"
 	"syscall"
 	"time"
+
+	"golang.org/x/sys/unix"
 )
 
 type EtherType uint16
@@ -17,23 +20,49 @@ const (
 	IPv4_PROTOCOL EtherType = 0x0800
 	IPv6_PROTOCOL EtherType = 0x086DD
 
-	_ Type = iota
-	SockRaw
-	SockDatagram
+	// vlan tag protocol identifiers
+	VLAN_PROTOCOL     EtherType = 0x8100 // 802.1Q customer tag
+	QinQ_PROTOCOL     EtherType = 0x88A8 // 802.1ad service tag
+	QinQ_OLD_PROTOCOL EtherType = 0x9100 // pre-standard QinQ tag, still used by some switches
+)
+
+const (
+	// the frames are read and written with their link layer header
+	SockRaw Type = syscall.SOCK_RAW
+	// cooked mode, the kernel strips the link layer header of the read frames
+	// and builds it for the written ones from the destination *Address
+	SockDatagram Type = syscall.SOCK_DGRAM
 )
 
 var (
 	// Errors
 	ErrInvalidClient = errors.New("Error invalid client source ip address")
 	ErrInvalidIP     = errors.New("Error invalid ip address given")
+	ErrInvalidCIDR   = errors.New("Error invalid CIDR given")
+	// the start of the range is after its end
+	ErrInvalidRange = errors.New("Error invalid ip range, start is after the end")
+	// the start and the end of the range are not both IPv4 or both IPv6
+	ErrMixedFamily = errors.New("Error ip range mixes IPv4 and IPv6 addresses")
+	// incrementing went past the last address of the family
+	ErrIPOverflow = errors.New("Error ip address overflow")
+	// the received frame does not carry an arp packet
+	ErrInvalidARPPacket = errors.New("Invalid ARP packet")
+	// the hardware address is too long
+	ErrInvalidMAC = errors.New("Error invalid mac address")
+	// the address given to WriteTo is not one the connection can send to
+	ErrInvalidAddr = errors.New("Error invalid destination address")
+	// the socket type is neither SockRaw nor SockDatagram
+	ErrInvalidSocketType = errors.New("Error invalid packet socket type")
 )
 
 type EthernetHeader struct {
 	DestAddr net.HardwareAddr // 6 bytes, transmitted as-is
 	// source hardware address for the frame (ethernet)
 	SourceAddr net.HardwareAddr // 6 bytes, transmitted as-is
-	EtherType  EtherType
-	Payload    []byte
+	// the vlan tags between the source address and the ether type, the outer one first
+	VLANs     []VLANTag // 4 bytes each
+	EtherType EtherType
+	Payload   []byte
 }
 
 type Frame interface {
@@ -43,8 +72,8 @@ type Frame interface {
 }
 
 type IPv4Header struct {
-	Version        uint8  // in Version also the IHL (HeaderLen) can be done (4 bits + 4 bits)
-	HeaderLen      uint8  // IHL
+	Version        uint8  // 4 bits, always 4
+	HeaderLen      uint8  // IHL, 4 bits, header length in 32 bit words
 	Service        uint8  // DSCP/ECN
 	TotalLen       uint16 // total packet length (65535 bytes = max)
 	Id             uint16
@@ -99,9 +128,16 @@ const (
 	OperationReply   Operation = 2
 )
 
+// the link layer address of a packet socket (sockaddr_ll)
+// the RawConn returns the sender of every read frame as one and sends to it in WriteTo
 type Address struct {
 	HardwareAddr net.HardwareAddr
 	// IpAddr       netip.Addr
+
+	// the ether type of the frame, when zero WriteTo uses the protocol the socket was bound to
+	Protocol EtherType
+	// to whom the received frame was sent, not used by WriteTo
+	PacketType PacketType
 }
 
 // this is now missing network and string method to implement the net.Addr inteface
@@ -109,67 +145,282 @@ var _ net.Addr = &Address{}
 
 // return the network name for the address
 func (adr *Address) Network() string {
-	return "network"
+	return "packet"
 }
 
 func (adr *Address) String() string {
 	return adr.HardwareAddr.String()
 }
 
+// the sockaddr_ll to send to on the interface
+func (adr *Address) sockaddr(ifIndex int, protocol EtherType) (*syscall.SockaddrLinklayer, error) {
+	sa := &syscall.SockaddrLinklayer{
+		Protocol: htons(uint16(protocol)),
+		Ifindex:  ifIndex,
+		Halen:    uint8(len(adr.HardwareAddr)),
+	}
+	if len(adr.HardwareAddr) > len(sa.Addr) {
+		return nil, ErrInvalidMAC
+	}
+	if adr.Protocol != 0 {
+		sa.Protocol = htons(uint16(adr.Protocol))
+	}
+	copy(sa.Addr[:], adr.HardwareAddr)
+	return sa, nil
+}
+
+// the link layer address of the ip packet on an interface without hardware addresses, only the protocol says what it is
+func ipSockaddr(a *net.IPAddr, ifIndex int) (*syscall.SockaddrLinklayer, error) {
+	protocol := IPv6_PROTOCOL
+	switch {
+	case a.IP.To4() != nil:
+		protocol = IPv4_PROTOCOL
+	case a.IP.To16() == nil:
+		return nil, ErrInvalidAddr
+	}
+	return &syscall.SockaddrLinklayer{Protocol: htons(uint16(protocol)), Ifindex: ifIndex}, nil
+}
+
+// the same as sockaddr but as the struct sockaddr_ll the kernel takes, for the msg_name of sendmmsg
+func (adr *Address) rawSockaddr(ifIndex int, protocol EtherType) (unix.RawSockaddrLinklayer, error) {
+	sa, err := adr.sockaddr(ifIndex, protocol)
+	if err != nil {
+		return unix.RawSockaddrLinklayer{}, err
+	}
+	return unix.RawSockaddrLinklayer{
+		Family:   unix.AF_PACKET,
+		Protocol: sa.Protocol,
+		Ifindex:  int32(sa.Ifindex),
+		Halen:    sa.Halen,
+		Addr:     sa.Addr,
+	}, nil
+}
+
+// the sender of the frame from the address recvfrom or recvmsg returned
+func linkAddress(sa syscall.Sockaddr) *Address {
+	sll, ok := sa.(*syscall.SockaddrLinklayer)
+	if !ok {
+		return nil
+	}
+	halen := min(int(sll.Halen), len(sll.Addr))
+	return &Address{
+		HardwareAddr: append(net.HardwareAddr(nil), sll.Addr[:halen]...),
+		Protocol:     EtherType(htons(sll.Protocol)),
+		PacketType:   PacketType(sll.Pkttype),
+	}
+}
+
+// same as linkAddress for the raw sockaddr_ll the kernel puts into the ring
+func rawLinkAddress(sll *unix.RawSockaddrLinklayer) *Address {
+	halen := min(int(sll.Halen), len(sll.Addr))
+	return &Address{
+		HardwareAddr: append(net.HardwareAddr(nil), sll.Addr[:halen]...),
+		Protocol:     EtherType(htons(sll.Protocol)),
+		PacketType:   PacketType(sll.Pkttype),
+	}
+}
+
+// to whom the received frame was sent (sll_pkttype)
+type PacketType uint8
+
+const (
+	PacketHost      PacketType = unix.PACKET_HOST      // to us
+	PacketBroadcast PacketType = unix.PACKET_BROADCAST // to everyone on the link
+	PacketMulticast PacketType = unix.PACKET_MULTICAST // to a multicast group
+	PacketOtherHost PacketType = unix.PACKET_OTHERHOST // to someone else, seen in promiscuous mode
+	PacketOutgoing  PacketType = unix.PACKET_OUTGOING  // sent by us (or anyone on this machine)
+)
+
+var packetTypeNames = map[PacketType]string{
+	PacketHost:      "host",
+	PacketBroadcast: "broadcast",
+	PacketMulticast: "multicast",
+	PacketOtherHost: "otherhost",
+	PacketOutgoing:  "outgoing",
+}
+
+func (t PacketType) String() string {
+	if name, ok := packetTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("PacketType(%d)", uint8(t))
+}
+
 var _ net.PacketConn = &RawConn{}
 
+// close the socket, the blocked reads and writes return net.ErrClosed
+// the rings are unmapped once the reads and writes using them returned
 func (rc *RawConn) Close() error {
-	return syscall.Close(rc.fd)
+	rc.mu.Lock()
+	if rc.closed.Load() {
+		rc.mu.Unlock()
+		return net.ErrClosed
+	}
+	rc.closed.Store(true)
+	rc.mu.Unlock()
+
+	// the kernel drops them with the socket too, but the interface should not stay promiscuous by mistake
+	rc.dropMemberships()
+
+	// the file wakes up the blocked reads and writes and closes the socket once they returned
+	err := rc.f.Close()
+	if uerr := rc.releaseRing(); err == nil {
+		err = uerr
+	}
+	return err
 }
 
 func (rc *RawConn) LocalAddr() net.Addr {
 	return rc.localAddr
 }
 
-// read a packet from connection
+// read a packet from connection, the address is the *Address of the sender
 func (rc *RawConn) ReadFrom(b []byte) (int, net.Addr, error) {
-	n, _, err := syscall.Recvfrom(rc.fd, b, 0)
+	n, from, _, err := rc.readFrom(b)
 	if err != nil {
 		return 0, nil, err
 	}
-	return n, rc.localAddr, err
+	// do not return a typed nil in the interface
+	if from == nil {
+		return n, nil, nil
+	}
+	return n, from, nil
 }
 
 // send a packet through the raw connection
+// to an *Address with sendto, so the kernel knows the destination (needed for the cooked sockets),
+// nil sends it on the bound socket as it is, the frame carries its own destination so a cooked socket needs an *Address
+// an ip address (*net.IPAddr) is a destination only for the ip level sockets, the cooked ones on an interface
+// without hardware addresses (tun, ppp), everywhere else the link layer destination can not be made up from it
 func (rc *RawConn) WriteTo(b []byte, addr net.Addr) (int, error) {
-	n, err := syscall.Write(rc.fd, b)
+	var sa *syscall.SockaddrLinklayer
+	switch a := addr.(type) {
+	case *Address:
+		var err error
+		if sa, err = a.sockaddr(rc.ifIndex, rc.protocol); err != nil {
+			return 0, err
+		}
+	case *net.IPAddr:
+		if !rc.Cooked() || rc.hwAddrLen != 0 {
+			return 0, ErrInvalidAddr
+		}
+		var err error
+		if sa, err = ipSockaddr(a, rc.ifIndex); err != nil {
+			return 0, err
+		}
+	case nil:
+		if rc.Cooked() {
+			return 0, ErrInvalidAddr
+		}
+	default:
+		return 0, ErrInvalidAddr
+	}
+
+	// with the tx ring the kernel takes the frames only from the ring, the address goes with the flush
+	if rc.tx != nil {
+		if err := rc.QueueFrame(b); err != nil {
+			return 0, err
+		}
+		// a nil *SockaddrLinklayer would not be a nil Sockaddr
+		var to syscall.Sockaddr
+		if sa != nil {
+			to = sa
+		}
+		if err := rc.flush(to); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	err := rc.write(func(fd int) error {
+		if sa == nil {
+			_, err := syscall.Write(fd, b)
+			return err
+		}
+		return syscall.Sendto(fd, b, 0, sa)
+	})
 	if err != nil {
 		return 0, err
 	}
+	return len(b), nil
+}
 
-	return n, nil
+// the socket is non blocking and its file is in the go poller, so a read that has nothing to take
+// parks the goroutine until the socket is readable, the read deadline passes or the conn is closed,
+// a deadline set while the read is blocked wakes it up too
+func (rc *RawConn) read(fn func(fd int) error) error {
+	var err error
+	if cerr := rc.conn.Read(func(fd uintptr) bool {
+		err = ignoringEINTR(func() error { return fn(int(fd)) })
+		return err != unix.EAGAIN
+	}); cerr != nil {
+		return rc.closedErr(cerr)
+	}
+	return err
 }
 
-func (rc *RawConn) SetDeadline(t time.Time) error {
-	rc.mu.Lock()
-	defer rc.mu.Unlock()
+// same as read for the writes, it waits until the socket (or the tx ring) has space
+func (rc *RawConn) write(fn func(fd int) error) error {
+	var err error
+	if cerr := rc.conn.Write(func(fd uintptr) bool {
+		err = ignoringEINTR(func() error { return fn(int(fd)) })
+		return err != unix.EAGAIN
+	}); cerr != nil {
+		return rc.closedErr(cerr)
+	}
+	return err
+}
 
-	rc.readDeadline = t
-	rc.writeDeadline = t
-	return nil
+// run fn on the socket, after Close it is not run at all so a reused fd number is never touched
+func (rc *RawConn) control(fn func(fd int) error) error {
+	var err error
+	if cerr := rc.conn.Control(func(fd uintptr) {
+		err = fn(int(fd))
+	}); cerr != nil {
+		return rc.closedErr(cerr)
+	}
+	return err
 }
 
-func (rc *RawConn) SetReadDeadline(t time.Time) error {
-	rc.mu.Lock()
-	defer rc.mu.Unlock()
+// the file says "use of closed file", report it the way net.Conn does
+func (rc *RawConn) closedErr(err error) error {
+	if err != nil && rc.closed.Load() {
+		return net.ErrClosed
+	}
+	return err
+}
 
-	rc.readDeadline = t
-	return nil
+// the poller wakes us up for a socket error too (the interface went away), the ring has nothing then
+// so the error is taken from the socket instead of waiting again
+func socketError(fd int) error {
+	errno, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		return err
+	}
+	if errno != 0 {
+		return syscall.Errno(errno)
+	}
+	return unix.EAGAIN
+}
 
+func ignoringEINTR(fn func() error) error {
+	for {
+		if err := fn(); err != unix.EINTR {
+			return err
+		}
+	}
 }
 
-func (rc *RawConn) SetWriteDeadline(t time.Time) error {
-	rc.mu.Lock()
-	defer rc.mu.Unlock()
+func (rc *RawConn) SetDeadline(t time.Time) error {
+	return rc.closedErr(rc.f.SetDeadline(t))
+}
 
-	rc.writeDeadline = t
-	return nil
+func (rc *RawConn) SetReadDeadline(t time.Time) error {
+	return rc.closedErr(rc.f.SetReadDeadline(t))
+}
 
+func (rc *RawConn) SetWriteDeadline(t time.Time) error {
+	return rc.closedErr(rc.f.SetWriteDeadline(t))
 }
 
 func checksum(data []byte) uint16 {
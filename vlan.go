@@ -0,0 +1,71 @@
+package netlibk
+
+import "encoding/binary"
+
+// one 802.1Q (or 802.1ad) tag of the ethernet frame
+type VLANTag struct {
+	TPID EtherType // tag protocol, VLAN_PROTOCOL when zero
+	PCP  uint8     // priority code point, 3 bits
+	DEI  bool      // drop eligible indicator
+	VID  uint16    // vlan id, 12 bits
+}
+
+func isVLANProtocol(t EtherType) bool {
+	return t == VLAN_PROTOCOL || t == QinQ_PROTOCOL || t == QinQ_OLD_PROTOCOL
+}
+
+// the tag control information, so the pcp, dei and vid in 16 bits
+func (t VLANTag) tci() uint16 {
+	tci := uint16(t.PCP&0x7)<<13 | t.VID&0x0fff
+	if t.DEI {
+		tci |= 1 << 12
+	}
+	return tci
+}
+
+func (t *VLANTag) setTCI(tci uint16) {
+	t.PCP = uint8(tci >> 13)
+	t.DEI = tci&(1<<12) != 0
+	t.VID = tci & 0x0fff
+}
+
+// write the 4 bytes of the tag into b
+func (t VLANTag) marshal(b []byte) {
+	tpid := t.TPID
+	if tpid == 0 {
+		tpid = VLAN_PROTOCOL
+	}
+	binary.BigEndian.PutUint16(b[0:2], uint16(tpid))
+	binary.BigEndian.PutUint16(b[2:4], t.tci())
+}
+
+// read the tag from the 4 bytes in b
+func (t *VLANTag) unmarshal(b []byte) {
+	t.TPID = EtherType(binary.BigEndian.Uint16(b[0:2]))
+	t.setTCI(binary.BigEndian.Uint16(b[2:4]))
+}
+
+// ask the kernel for the packet aux data, which has the vlan tag it stripped from the frame (vlan offload)
+// with it the read frames get the tag back in place, so the EthernetHeader sees it
+func ListenAuxData() ListenOption {
+	return func(lc *listenConfig) {
+		lc.auxData = true
+	}
+}
+
+// insert the tag after the mac addresses of the n byte frame in b, returns the new frame length
+// if b is too small, the end of the frame is cut off
+func insertVLANTag(b []byte, n int, tag VLANTag) int {
+	if n < 12 || len(b) < 16 {
+		return n
+	}
+
+	end := n + 4
+	if end > len(b) {
+		end = len(b)
+	}
+	copy(b[16:end], b[12:n])
+	tag.marshal(b[12:16])
+
+	return end
+}